@@ -5,36 +5,139 @@ PICL.go: The PICL parser & Code generator
 package PICL
 
 import (
-	"bufio"
 	"bytes"
 	"fmt"
-   "io"
+	"io"
+	"math/bits"
 	"picl-go/PICS"
 )
 
-// Item forms
+// Item forms, see Symbol.Form
 const (
-	variable  = 1
-	constant  = 2
-	procedure = 3
+	Variable  = 1
+	Constant  = 2
+	Procedure = 3
+	Table     = 4
 )
 
 type Object *ObjDesc
 type ObjDesc struct {
 	name               []byte
 	form, typ, ptyp, a int
+	size               int      // elements of an array or table, 0 otherwise
+	data               []int    // entries of a table
+	params             []Object // of a procedure
 	next               Object
 }
 
-var (
-	sym                    int
-	IdList, IdList0, undef Object
-	Pc, dc                 int
-	Err                    bool
-	errs                   int
-	Code                   [1024]int
+// Compiler holds all state of a compilation, so several modules can be
+// compiled in one process. A Compiler must not be shared between goroutines.
+type Compiler struct {
+	IndexChecks bool // check array indices at run time
+
+	dev                     *Device
+	sc                      *PICS.Scanner
+	sym                     int
+	idList, universe, undef Object
+	pc, dc                  int
+	rp, banks               int   // current bank, number of banks
+	rpAt                    []int // bank at each forward jump
+	errs, errpos            int
+	diags                   []Diagnostic
+	code                    []int
+	proc                    []byte           // procedure being compiled, for diagnostics
+	temps, pairs            []int            // registers for intermediate results
+	ntemp, npairs           int              // temporaries in use
+	rtRegs                  []int            // registers of the runtime routines
+	rtCalls                 [nRoutines][]int // call sites of each routine
+	tables                  []Object         // tables declared
+	data                    []Range          // entries of the tables
+	top                     int              // last register for variables
+	isr                     Object           // interrupt procedure
+	vectorJump              bool             // the vector holds a GOTO to it, see interrupt
+	isrRuntime              bool             // it calls runtime routines
+	saved                   [nSaved]int      // registers of its context save
+	config                  int              // configuration word, -1 if not declared
+	eeprom                  []int            // initial data EEPROM contents
+	lines                   []Line           // source of the code, for the listing
+	names                   map[int]string   // register names, for the listing
+	internal                []Symbol         // registers of the compiler's own
+	reg, regPc              int              // register addressed by the instruction at regPc
+	module                  []byte           // name of the module
+	blocks                  []Block          // code and scopes of the procedures
+}
+
+// Diagnostic severities
+type Severity int
+
+const (
+	Error Severity = iota
+	Warning
 )
 
+func (s Severity) String() string {
+	if s == Warning {
+		return "warning"
+	}
+	return "error"
+}
+
+// Diagnostic is a message about the source text, tied to a position in it
+type Diagnostic struct {
+	Pos      PICS.Pos
+	Severity Severity
+	Code     int
+	Message  string
+}
+
+func (d Diagnostic) String() string {
+	return fmt.Sprintf("%s: %s: %s", d.Pos, d.Severity, d.Message)
+}
+
+// Line ties code to the source: the code from Addr up to the next Line was
+// generated for the source at Pos. Pos is zero for the runtime routines and
+// tables
+type Line struct {
+	Addr int
+	Pos  PICS.Pos
+}
+
+// Symbol is a module scope entry of the symbol table
+type Symbol struct {
+	Name                  string
+	Form, Typ, Ptyp, Addr int
+	Len                   int // elements of an array or table
+}
+
+// Memory used by a module and available on the device
+type Usage struct {
+	Prog, ProgSize int // words of program memory
+	RAM, RAMSize   int // general purpose registers
+}
+
+func (u Usage) String() string {
+	return fmt.Sprintf("Program memory: %d of %d words (%d%%), RAM: %d of %d bytes (%d%%)",
+		u.Prog, u.ProgSize, u.Prog*100/u.ProgSize, u.RAM, u.RAMSize, u.RAM*100/u.RAMSize)
+}
+
+// Result of a compilation: code image, symbol table and diagnostics
+type Result struct {
+	Code        []int
+	Symbols     []Symbol
+	Diagnostics []Diagnostic
+	Errors      int
+	Usage       Usage
+	Data        []Range        // tables in program memory
+	Config      int            // configuration word, -1 without CONFIG
+	EEPROM      []int          // initial data EEPROM contents
+	Lines       []Line         // source of the code, in order of address
+	Names       map[int]string // register addressed by the instruction at each address
+	Source      []byte         // source text as read
+	Module      string         // name of the module
+	Blocks      []Block        // program memory by procedure, in order of address
+	Internal    []Symbol       // registers of the compiler's own, temporaries etc
+}
+
 // Instruction tables for decoder
 var table0 = [...]string{
 	"MOVWF ", "CLRF  ", "SUBWF ", "DECF  ",
@@ -52,890 +155,1923 @@ var table2 = [...]string{
 }
 
 var table3 = [...]string{
-	"MOVLW ", "", "", "",
-	"RETLW ", "", "", "",
+	"MOVLW ", "MOVLW ", "MOVLW ", "MOVLW ",
+	"RETLW ", "RETLW ", "RETLW ", "RETLW ",
 	"IORLW ", "ANDLW ", "XORLW ", "",
-	"SUBLW ", "ADDLW ",
+	"SUBLW ", "SUBLW ", "ADDLW ", "ADDLW ",
 }
 
 var forms = [...]string{
-   "", "variable", "constant", "procedure",
+	"", "variable", "constant", "procedure", "table",
 }
 
 var types = [...]string{
-   "<>", "int", "set", "bool",
+	"<>", "int", "set", "bool", "word",
 }
 
 var regs = [...]string{"W", "F"}
 
 var parseErr = [...]string{
-   "",
-   "",
-   "Left side of an assignment must be a variable",
-   "Procedure name expected before (",
-   "",
-   "Equals expected after constant's name",
-   "",
-   "Number expected",
-   ") expected after expression",
-   "Operator expected",
-   "Identifier expected or unknown identifier",
-   "Bit selector expected after .",
-   "Types in a dyadic expression must match",
-   "Integer type not allowed with *",
-   "THEN or DO expected after condition",
-   "END expected after IF block",
-   "END expected after WHILE block",
-   "",
-   "END expected after PROCEDURE block (check semicolons after each statement)",
-   "END expected after MODULE block",
-   "Semicolon expected",
-   "BEGIN expected",
-   "Names at beginning and end do not match",
-   "",
-   "",
-   "UNTIL <condition> or END expected after REPEAT block",
-}
-   
-   
-   
-   
-// Parse error
-func Mark(msg string, n int) {
-	fmt.Printf("Parse error - %s, code: %d %s\n", msg, n, parseErr[n])
-	Err = true
-	errs += 1
+	"",
+	"",
+	"Left side of an assignment must be a variable",
+	"Procedure name expected before (",
+	"",
+	"Equals expected after constant's name",
+	"",
+	"Number expected",
+	") expected after expression",
+	"Operator expected",
+	"Identifier expected or unknown identifier",
+	"Bit number, or H or L of a WORD, expected after .",
+	"Types in a dyadic expression must match",
+	"SET type not allowed with / and MOD",
+	"THEN or DO expected after condition",
+	"END expected after IF block",
+	"END expected after WHILE block",
+	"",
+	"END expected after PROCEDURE block (check semicolons after each statement)",
+	"END expected after MODULE block",
+	"Semicolon expected",
+	"BEGIN expected",
+	"Names at beginning and end do not match",
+	"",
+	"",
+	"UNTIL <condition> or END expected after REPEAT block",
+	"Statement expected",
+	"Program memory exhausted at procedure %s",
+	"RAM exhausted by variable %s",
+	"Relation expected",
+	"Only + and - allowed with WORD",
+	"WORD not allowed as result",
+	"Number too large",
+	"Bit selector not allowed here",
+	"Wrong number of arguments",
+	"Argument type does not match parameter",
+	"RETURN not allowed in a procedure without result type",
+	"Type of RETURN expression does not match result type",
+	"RETURN expected in a procedure with result type",
+	"Procedure without result used in an expression",
+	"Result of procedure not used",
+	"Array or table expected before [",
+	"Index expected after array or table name",
+	"Index out of range",
+	"] expected after index",
+	"OF expected after array length",
+	"WORD not allowed as element type",
+	"INT index expected",
+	"Array length out of range",
+	"Table entries expected, eg = (1, 2, 3)",
+	"Only one interrupt procedure allowed",
+	"",
+	"Interrupt procedure has no parameters and no result",
+	"Interrupt procedure cannot be called",
+	"No register common to all banks left for saving W",
+	"Unknown configuration field %s",
+	"Unknown value %s of %s",
+	"Value does not fit into %s",
+	"Equals expected after configuration field",
+	"Data EEPROM exhausted by %s",
+	"END expected after ASM block",
+	"Assembler: %s",
+	"ORG and __CONFIG not allowed in an ASM block",
+	"*, / and MOD not allowed both in the interrupt procedure and elsewhere",
+	"%s is in bank %d, bank %d is selected",
+}
+
+// Parse error at the current symbol, args fill in the message
+// Errors too close to the previous one are most likely follow-on errors
+// and are not reported
+func (c *Compiler) Mark(n int, args ...interface{}) {
+	p := c.sc.Pos.Off
+	if c.errs == 0 || p > c.errpos+2 {
+		msg := parseErr[n]
+		if len(args) > 0 {
+			msg = fmt.Sprintf(msg, args...)
+		}
+		c.diags = append(c.diags, Diagnostic{c.sc.Pos, Error, n, msg})
+		c.errs += 1
+	}
+	c.errpos = p
+}
+
+// Symbols at which parsing resumes after an error
+var follow = [...]int{
+	PICS.Semicolon, PICS.End, PICS.Elsif, PICS.Else, PICS.Until,
+	PICS.Return, PICS.Proced, PICS.Begin,
+}
+
+// Panic mode error recovery: skip symbols up to one of stop, or EOF
+func (c *Compiler) sync(stop ...int) {
+	for c.sym != PICS.Eof {
+		for _, s := range stop {
+			if c.sym == s {
+				return
+			}
+		}
+		c.sc.Get(&c.sym)
+	}
+}
+
+// Does sym name a type?
+func typeSym(sym int) bool {
+	return sym >= PICS.Int && sym <= PICS.Word
+}
+
+// Is sym an arithmetic operator?
+func arith(sym int) bool {
+	return (sym >= PICS.Ast && sym <= PICS.Minus) || sym == PICS.Mod
+}
+
+// Can sym start a statement?
+func stmtStart(sym int) bool {
+	return (sym >= PICS.Op && sym <= PICS.Lparen) || (sym >= PICS.Ident && sym <= PICS.Ror) || sym == PICS.Asm
+}
+
+// Can sym end a statement?
+func stmtEnd(sym int) bool {
+	for _, s := range follow {
+		if sym == s {
+			return true
+		}
+	}
+	return sym == PICS.Rparen || sym == PICS.Eof
 }
 
 // Look up a name in the symbol table
 // Linear search
-func this(id []byte) Object {
+func (c *Compiler) this(id []byte) Object {
 	var obj Object
 
-	obj = IdList
+	obj = c.idList
 	for obj != nil && !(bytes.Compare(id, obj.name) == 0) {
 		obj = obj.next
 	}
 	if obj == nil {
-		Mark("this", 10)
-		obj = undef
+		c.Mark(10)
+		obj = c.undef
 	}
 	return obj
 }
 
 // Add a new value to the symbol table
-func enter(id string, form int, typ int, a int) {
+func (c *Compiler) enter(id string, form int, typ int, a int) {
 	obj := new(ObjDesc)
 	obj.name = make([]byte, 0, 16)
 	obj.name = append(obj.name, id...)
 	obj.form = form
 	obj.typ = typ
 	obj.a = a
-	obj.next = IdList
-	IdList = obj
+	obj.next = c.idList
+	c.idList = obj
+}
+
+// Allocate a register for variable id
+func (c *Compiler) alloc(id []byte) int {
+	a := c.dc
+	if a == c.top+1 {
+		c.Mark(28, id)
+	}
+	c.dc += 1
+	return a
+}
+
+// Name register a, allocated for the compiler's own use, for the listing
+// and the assembly source. The names start with _, unlike PICL names
+func (c *Compiler) internalReg(a int, name string, typ int) int {
+	c.internal = append(c.internal, Symbol{Name: name, Form: Variable, Typ: typ, Addr: a})
+	return a
+}
+
+// Declare variable id, a WORD takes two registers, an array of n elements
+// n registers
+func (c *Compiler) variable(id []byte, typ int, n int) {
+	a := c.alloc(id)
+	if typ == PICS.Word_t {
+		c.alloc(id)
+	}
+	for i := 1; i < n; i += 1 {
+		c.alloc(id)
+	}
+	c.enter(string(id), Variable, typ, a)
+	c.idList.size = n
+}
+
+// Type of a variable declaration, eg INT or ARRAY 16 OF INT
+// n is the number of elements of an array, 0 otherwise
+func (c *Compiler) varType() (typ int, n int) {
+	if c.sym == PICS.Array {
+		c.sc.Get(&c.sym)
+		if c.sym == PICS.Number {
+			n = c.sc.Val
+			c.sc.Get(&c.sym)
+		} else if c.sym == PICS.Ident {
+			obj := c.this(c.sc.Id)
+			if obj.form != Constant && obj != c.undef {
+				c.Mark(7)
+			}
+			n = obj.a
+			c.sc.Get(&c.sym)
+		} else {
+			c.Mark(7)
+		}
+		if n < 1 || n > 0x100 {
+			c.Mark(48)
+			n = 1
+		}
+		if c.sym == PICS.Of {
+			c.sc.Get(&c.sym)
+		} else {
+			c.Mark(45)
+		}
+		if !typeSym(c.sym) {
+			c.Mark(10)
+			return 0, n
+		}
+		if c.sym == PICS.Word {
+			c.Mark(46)
+		}
+	}
+	typ = c.sym - PICS.Int + 1
+	c.sc.Get(&c.sym)
+	return typ, n
+}
+
+// Bank states besides 0-3
+const (
+	unknown     = -1 // bank bits not known at compile time
+	unreachable = -2 // no code path leads here
+)
+
+// Bank state where two code paths meet
+func merge(a int, b int) int {
+	if a == unreachable || a == b {
+		return b
+	}
+	if b == unreachable {
+		return a
+	}
+	return unknown
+}
+
+// Set the bank bits RP0 and RP1 in STATUS for bank b, if necessary
+func (c *Compiler) setBank(b int) {
+	if c.rp == b || b < 0 {
+		return
+	}
+	if c.rp < 0 || (c.rp^b)&1 != 0 {
+		c.emit1(b&1, 5, 3)
+	}
+	if (c.rp < 0 && c.banks > 2) || (c.rp >= 0 && (c.rp^b)&2 != 0) {
+		c.emit1(b>>1, 6, 3)
+	}
+	c.rp = b
+}
+
+// Can register a be accessed without switching banks?
+func (c *Compiler) inBank(a int) bool {
+	return !c.dev.Banked(a) || c.rp == a/0x80
+}
+
+// File register field for address a, selecting its bank first
+func (c *Compiler) file(a int) int {
+	if !c.inBank(a) {
+		c.setBank(a / 0x80)
+	}
+	c.reg, c.regPc = a, c.pc
+	return a % 0x80
+}
+
+// Writing STATUS may change the bank bits behind our back
+func (c *Compiler) clobber(a int) {
+	if a%0x80 == 3 {
+		c.rp = unknown
+	}
+}
+
+// Call a procedure, by convention in bank 0
+func (c *Compiler) call(a int) {
+	c.setBank(0)
+	c.emit(0x20, a)
+	c.rp = 0
+}
+
+// Put down word w at pc
+// Past the end of program memory, code is still generated so that the
+// compiler keeps going, but the overflow is reported once
+func (c *Compiler) put(w int) {
+	if c.pc == len(c.code) {
+		if c.pc == c.dev.codeSize() {
+			c.Mark(27, c.proc)
+		}
+		c.code = append(c.code, 0)
+		c.rpAt = append(c.rpAt, 0)
+	}
+	c.code[c.pc] = w
+	c.name(w)
+	c.pc += 1
+}
+
+// Note the name of the register addressed by instruction w at pc, see file
+// Registers common to all banks are also named when addressed directly
+func (c *Compiler) name(w int) {
+	if c.regPc != c.pc && w < 0x2000 && !c.dev.Banked(w%0x80) {
+		c.reg, c.regPc = w%0x80, c.pc
+	}
+	delete(c.names, c.pc)
+	if c.regPc == c.pc {
+		if n := c.regName(c.reg); n != "" {
+			c.names[c.pc] = n
+		}
+	}
+	c.regPc = -1
+}
+
+// Name of register a: a variable in scope, with an offset into an array or
+// WORD, a predeclared register, a parameter of a procedure in scope as
+// proc.name, or one of the compiler's own. "" if a has no name
+func (c *Compiler) regName(a int) string {
+	// Name of a within variable obj
+	in := func(obj Object, prefix string) string {
+		n := obj.size
+		if obj.typ == PICS.Word_t {
+			n = 2
+		} else if n == 0 {
+			n = 1
+		}
+		if a < obj.a || a >= obj.a+n {
+			return ""
+		} else if a > obj.a {
+			return fmt.Sprintf("%s%s+%d", prefix, obj.name, a-obj.a)
+		}
+		return prefix + string(obj.name)
+	}
+
+	for obj := c.idList; obj != nil; obj = obj.next {
+		if obj.form == Variable {
+			if n := in(obj, ""); n != "" {
+				return n
+			}
+		} else if obj.form == Procedure {
+			for _, p := range obj.params {
+				if n := in(p, string(obj.name)+"."); n != "" {
+					return n
+				}
+			}
+		}
+	}
+	for _, s := range c.internal {
+		if a == s.Addr {
+			return s.Name
+		} else if s.Typ == PICS.Word_t && a == s.Addr+1 {
+			return s.Name + "+1"
+		}
+	}
+	return ""
+}
+
+// The code from pc on is generated for the source at pos
+func (c *Compiler) line(pos PICS.Pos) {
+	n := len(c.lines)
+	if n > 0 && c.lines[n-1].Addr == c.pc {
+		n -= 1
+		c.lines = c.lines[:n]
+	}
+	if n > 0 && c.lines[n-1].Pos.Line == pos.Line {
+		return
+	}
+	c.lines = append(c.lines, Line{c.pc, pos})
+}
+
+// Put down a forward jump, linked into fixup chain L
+func (c *Compiler) jump(L int) int {
+	c.put(L)
+	c.rpAt[c.pc-1] = c.rp
+	return c.pc - 1
+}
+
+// Do all jumps of chain L leave in bank b?
+func (c *Compiler) allIn(L int, b int) bool {
+	for ; L != 0; L = c.code[L] {
+		if b >= 0 && c.rpAt[L] != b {
+			return false
+		}
+	}
+	return true
 }
 
 // Put down a regular opcode
-func emit(op int, a int) {
-	Code[Pc] = op*0x100 + a
-	Pc += 1
+func (c *Compiler) emit(op int, a int) {
+	c.put(op*0x100 + a)
 }
 
 // Put down BTFSS, BTFSC, BSF or BCF
-func emit1(op int, n int, a int) {
-	Code[Pc] = ((op+4)*8+n)*0x80 + a
-	Pc += 1
-}
-
-// Handle bit selector in set notation
-func index(n *int) {
-	*n = 0
-	if sym == PICS.Period {
-		PICS.Get(&sym)
-		if sym == PICS.Number {
-			*n = PICS.Val
-			PICS.Get(&sym)
+func (c *Compiler) emit1(op int, n int, a int) {
+	c.put(((op+4)*8+n)*0x80 + a)
+}
+
+// Handle selectors: index of an array element, bit selector in set
+// notation, H and L for the bytes of a WORD
+// n is -1 if there is no bit selector
+func (c *Compiler) selector(x Object, n *int) Object {
+	*n = -1
+	if c.sym == PICS.Lbrak {
+		c.sc.Get(&c.sym)
+		x = c.element(x, c.subscript(x))
+	} else if x.size > 0 {
+		c.Mark(42)
+	}
+	for c.sym == PICS.Period && *n < 0 {
+		c.sc.Get(&c.sym)
+		if c.sym == PICS.Number {
+			*n = c.sc.Val
+			c.sc.Get(&c.sym)
+		} else if c.sym == PICS.Ident && x.typ == PICS.Word_t && (string(c.sc.Id) == "L" || string(c.sc.Id) == "H") {
+			b := new(ObjDesc)
+			*b = *x
+			b.typ = PICS.Int_t
+			if c.sc.Id[0] == 'H' {
+				b.a += 1
+			}
+			x = b
+			c.sc.Get(&c.sym)
 		} else {
-			Mark("index", 11)
+			c.Mark(11)
 		}
 	}
+	return x
+}
+
+// Variable, possibly a byte of a WORD, where bits cannot be selected
+func (c *Compiler) designator(x Object) Object {
+	var n int
+
+	x = c.selector(x, &n)
+	if n >= 0 {
+		c.Mark(33)
+	}
+	return x
 }
 
-// Arithmetic expression handling
-func expression() {
-	var x, y Object
-	var op, xf, xt, xval, yt, yval int
+// Index of an element of array x, after the opening bracket
+// A constant index is checked against the bounds at once
+func (c *Compiler) subscript(x Object) item {
+	var i item
 
-	// Object or literal?
-	if sym == PICS.Ident {
-		x = this(PICS.Id)
-		xf = x.form
-		xt = x.typ
-		xval = x.a
-		PICS.Get(&sym)
-	} else if sym == PICS.Number {
-		xf = constant
-		xval = PICS.Val
-		xt = PICS.Typ
-		PICS.Get(&sym)
+	if x.size == 0 && x != c.undef {
+		c.Mark(41)
+	}
+	i = c.factor(&i)
+	i = c.chain(i)
+	if i.typ != PICS.Int_t && i.typ != 0 {
+		c.Mark(47)
+	} else if i.mode == Constant && x.size > 0 && i.a >= x.size {
+		c.Mark(43)
+	}
+	if c.sym == PICS.Rbrak {
+		c.sc.Get(&c.sym)
 	} else {
-		Mark("expression", 10)
-		xval = 0
+		c.Mark(44)
+	}
+	return i
+}
+
+// Element i of array x
+// A constant index selects the register itself. Otherwise the address is
+// computed into FSR and the element is accessed through INDF, with W
+// destroyed. If IndexChecks is set, an index out of range stops the
+// program in a loop like the one of ?, where a watchdog can reset it
+func (c *Compiler) element(x Object, i item) Object {
+	if x.size == 0 {
+		// Already reported
+		return x
 	}
-	// Is it a function procedure?
-	if sym == PICS.Lparen {
-		PICS.Get(&sym)
-		if x.form != procedure {
-			Mark("expression", 3)
+	if x.form == Table {
+		return c.entry(x, i)
+	}
+	e := new(ObjDesc)
+	*e = *x
+	e.size = 0
+	if i.mode == Constant {
+		e.a += i.a
+		return e
+	}
+	c.load(i)
+	if c.dev.RAMEnd >= 0x100 {
+		// IRP selects banks 2 and 3
+		c.emit1(x.a/0x100, 7, 3)
+	}
+	if c.IndexChecks {
+		c.emit(0, fsr+0x80)
+		c.emit(0x3C, x.size-1)
+		c.emit1(3, 0, 3)
+		c.emit(0x28, c.pc-1)
+		c.emit(0x30, x.a%0x100)
+		c.emit(0x07, fsr+0x80)
+	} else {
+		c.emit(0x3E, x.a%0x100)
+		c.emit(0, fsr+0x80)
+	}
+	e.a = indf
+	return e
+}
+
+// Indirect addressing registers, in all banks of every device
+const (
+	indf = 0x00
+	fsr  = 0x04
+)
+
+// Operand of an expression: a variable or constant not yet loaded, or a
+// value already computed into W
+type item struct {
+	mode, typ, a int
+}
+
+// Item mode besides the object forms
+const inW = 5
+
+// Opcodes for f op W and k op W, by operator and type
+// -1 if there is no single instruction for it
+var byteOps = map[int][2]int{PICS.Plus: {0x07, 0x04}, PICS.Minus: {0x02, 0x06}, PICS.Ast: {-1, 0x05}}
+var litOps = map[int][2]int{PICS.Plus: {0x3E, 0x38}, PICS.Minus: {0x3C, 0x3A}, PICS.Ast: {-1, 0x39}}
+
+// Get a register for an intermediate result
+// Temporaries are static like the local variables, each procedure has its
+// own. They are free again at the start of the next statement
+func (c *Compiler) temp() int {
+	if c.ntemp == len(c.temps) {
+		a := c.alloc([]byte("(temporary)"))
+		c.temps = append(c.temps, c.internalReg(a, fmt.Sprintf("_t%.2X", a), PICS.Int_t))
+	}
+	c.ntemp += 1
+	return c.temps[c.ntemp-1]
+}
+
+// Move x into W
+func (c *Compiler) load(x item) {
+	if x.typ == PICS.Word_t {
+		if x.mode == Constant {
+			c.Mark(32)
+		} else if x.mode != 0 {
+			c.Mark(12)
+		}
+	} else if x.mode == Variable {
+		c.emit(0x08, c.file(x.a))
+	} else if x.mode == Constant {
+		c.emit(0x30, x.a)
+	} else if x.mode != inW && x.mode != 0 {
+		c.Mark(10)
+	}
+}
+
+// Save x to a temporary if it is in W
+func (c *Compiler) spill(x *item) {
+	if x.mode == inW {
+		x.mode = Variable
+		x.a = c.temp()
+		c.emit(0, c.file(x.a)+0x80)
+	}
+}
+
+// Operand starting with identifier obj, which has been read
+// A function call is put down at once, see factor
+func (c *Compiler) ident(obj Object, x *item) item {
+	y := item{obj.form, obj.typ, obj.a}
+	if c.sym == PICS.Lparen {
+		c.sc.Get(&c.sym)
+		if obj.form != Procedure && obj != c.undef {
+			c.Mark(3)
+		} else if obj.form == Procedure && obj.typ == 0 {
+			c.Mark(39)
+		}
+		c.spill(x)
+		c.actuals(obj)
+		y.mode = inW
+	} else if obj.form == Variable && obj.a == indf {
+		// Fetch an array element at once, the next one needs FSR
+		c.load(y)
+		y.mode = inW
+	}
+	return y
+}
+
+// Can a value of type typ be assigned to a variable or passed to a
+// parameter of type vtyp? A byte takes a byte of any type, as in the
+// original PICL, a WORD takes an INT or a WORD
+func assignable(vtyp int, typ int) bool {
+	if typ == 0 {
+		// Already reported
+		return true
+	} else if vtyp == PICS.Word_t {
+		return typ == PICS.Int_t || typ == PICS.Word_t
+	}
+	return typ != PICS.Word_t
+}
+
+// Argument list, after the opening parenthesis, and call of procedure obj
+// Arguments go to the registers of the parameters, the last one in W
+// unless it is a WORD. They are stored only when all have been evaluated,
+// so that calls among them cannot overwrite them
+func (c *Compiler) actuals(obj Object) {
+	var args []item
+	var x item
+
+	if c.sym != PICS.Rparen {
+		for {
+			x = c.factor(&x)
+			x = c.chain(x)
+			args = append(args, x)
+			if c.sym != PICS.Comma {
+				break
+			}
+			c.spill(&args[len(args)-1])
+			c.sc.Get(&c.sym)
+		}
+	}
+	if c.sym == PICS.Rparen {
+		c.sc.Get(&c.sym)
+	} else {
+		c.Mark(8)
+	}
+	c.store(obj, args)
+	c.call(obj.a)
+}
+
+// Check the arguments of a call of obj and move them into place
+func (c *Compiler) store(obj Object, args []item) {
+	if obj.form != Procedure {
+		// Already reported
+		return
+	}
+	if len(args) != len(obj.params) {
+		c.Mark(34)
+		return
+	}
+	for i, x := range args {
+		if !assignable(obj.params[i].typ, x.typ) {
+			c.Mark(35)
 		}
-		if sym != PICS.Rparen {
-			expression()
+	}
+	last := len(args) - 1
+	if last < 0 {
+		return
+	}
+	if obj.params[last].typ == PICS.Word_t {
+		last += 1
+	} else if last > 0 {
+		c.spill(&args[last])
+	}
+	for i := 0; i < len(args); i += 1 {
+		if obj.params[i].typ == PICS.Word_t {
+			c.store16(obj.params[i].a, args[i])
+		} else if i < last {
+			c.load(args[i])
+			c.emit(0, c.file(obj.params[i].a)+0x80)
 		}
-		emit(0x20, x.a)
-		if sym == PICS.Rparen {
-			PICS.Get(&sym)
+	}
+	if last < len(args) {
+		c.load(args[last])
+	}
+}
+
+// Operand of an expression
+// x is the left operand, if it is in W it is saved to a temporary before
+// code for a function call or a parenthesized expression is put down
+func (c *Compiler) factor(x *item) item {
+	var y item
+
+	if c.sym == PICS.Ident {
+		obj := c.this(c.sc.Id)
+		c.sc.Get(&c.sym)
+		if c.sym == PICS.Lbrak {
+			// The index is computed in W
+			c.spill(x)
+		}
+		y = c.ident(c.designator(obj), x)
+	} else if c.sym == PICS.Number {
+		y = item{Constant, c.sc.Typ, c.sc.Val}
+		if y.a > 0xFFFF {
+			c.Mark(32)
+		} else if y.a > 0xFF {
+			y.typ = PICS.Word_t
+		}
+		c.sc.Get(&c.sym)
+	} else if c.sym == PICS.Lparen {
+		c.sc.Get(&c.sym)
+		c.spill(x)
+		y = c.factor(&y)
+		y = c.chain(y)
+		if y.typ != PICS.Word_t {
+			// WORD values stay where they are
+			c.load(y)
+			y = item{inW, y.typ, 0}
+		}
+		if c.sym == PICS.Rparen {
+			c.sc.Get(&c.sym)
 		} else {
-			Mark("expression", 8)
-		}
-	} else if (sym >= PICS.Ast) && (sym <= PICS.Minus) {
-		// dyadic expression
-		op = sym
-		PICS.Get(&sym)
-		yval = 0
-		if sym == PICS.Ident {
-			y = this(PICS.Id)
-			yt = y.typ
-			PICS.Get(&sym)
-			// Instruction selection
-			if y.form == variable {
-				emit(0x08, y.a)
-			} else if y.form == constant {
-				emit(0x30, y.a)
-			} else {
-				Mark("expression", 10)
+			c.Mark(8)
+		}
+	} else {
+		c.Mark(10)
+	}
+	return y
+}
+
+// Put down x op y, the result is left in W
+func (c *Compiler) operation(op int, x item, y item) item {
+	var t int
+
+	if x.typ == PICS.Word_t || y.typ == PICS.Word_t {
+		return c.operation16(op, x, y)
+	}
+	// Type check, unknown identifiers are already reported
+	if x.typ != y.typ && x.typ != 0 && y.typ != 0 {
+		c.Mark(12)
+	}
+	if x.typ == PICS.Int_t {
+		t = 0
+	} else {
+		t = 1
+	}
+	if (op == PICS.Slash) || (op == PICS.Mod) || (byteOps[op][t] < 0) {
+		if t == 0 {
+			return c.runtime(op, x, y)
+		} else if x.typ != 0 {
+			c.Mark(13)
+		}
+		return item{inW, x.typ, 0}
+	}
+	// Instruction selection
+	if x.mode == inW {
+		// W op y, all but INT subtraction commute
+		if y.mode == Variable {
+			c.emit(byteOps[op][t], c.file(y.a))
+			if op == PICS.Minus && t == 0 {
+				// y - W negated
+				c.emit(0x3C, 0)
 			}
-		} else if sym == PICS.Number {
-			yval = PICS.Val
-			yt = PICS.Typ
-			emit(0x30, yval)
-			PICS.Get(&sym)
-		}
-		// Type check
-		if xt != yt {
-			Mark("expression", 12)
-		}
-		// Instruction selection
-		if xf == variable {
-			if op == PICS.Plus {
-				if xt == PICS.Int_t {
-					emit(0x07, x.a)
-				} else {
-					emit(0x04, x.a)
-				}
-			} else if op == PICS.Minus {
-				if xt == PICS.Int_t {
-					emit(0x02, x.a)
-				} else {
-					emit(0x06, x.a)
-				}
-			} else if op == PICS.Ast {
-				if xt == PICS.Int_t {
-					Mark("expression", 13)
-				} else {
-					emit(0x05, x.a)
-				}
+		} else if y.mode == Constant {
+			if op == PICS.Minus && t == 0 {
+				c.emit(0x3E, -y.a&0xFF)
+			} else {
+				c.emit(litOps[op][t], y.a)
 			}
-		} else if xf == constant {
-			if op == PICS.Plus {
-				if xt == PICS.Int_t {
-					emit(0x3E, xval)
-				} else {
-					emit(0x38, xval)
-				}
-			} else if op == PICS.Minus {
-				if xt == PICS.Int_t {
-					emit(0x3C, xval)
-				} else {
-					emit(0x3A, xval)
-				}
-			} else if op == PICS.Ast {
-				if xt == PICS.Int_t {
-					Mark("expression", 13)
-				} else {
-					emit(0x39, xval)
-				}
+		} else if y.mode != 0 {
+			c.Mark(10)
+		}
+	} else {
+		c.load(y)
+		if x.mode == Variable {
+			c.emit(byteOps[op][t], c.file(x.a))
+		} else if x.mode == Constant {
+			c.emit(litOps[op][t], x.a)
+		} else if x.mode != 0 {
+			c.Mark(10)
+		}
+	}
+	return item{inW, x.typ, 0}
+}
+
+// Rest of an expression after its first operand x
+// Operators are left associative and of equal precedence. The result may
+// not be loaded yet
+func (c *Compiler) chain(x item) item {
+	var op int
+	var y item
+
+	for arith(c.sym) {
+		op = c.sym
+		c.sc.Get(&c.sym)
+		y = c.factor(&x)
+		x = c.operation(op, x, y)
+	}
+	return x
+}
+
+// Arithmetic expression handling, the value is left in W
+// Returns the type of the expression
+func (c *Compiler) expression() int {
+	var x item
+
+	x = c.factor(&x)
+	x = c.chain(x)
+	c.load(x)
+	return x.typ
+}
+
+// Put down the test of relation x rel y, skipping the next instruction
+// if it holds
+// x - y is computed, its carry and zero flags decide. Leq and Gtr are Geq
+// and Lss with the sides swapped
+func (c *Compiler) compare(rel int, x item, y item) {
+	if rel == PICS.Leq {
+		x, y = y, x
+		rel = PICS.Geq
+	} else if rel == PICS.Gtr {
+		x, y = y, x
+		rel = PICS.Lss
+	}
+	if x.typ == PICS.Word_t || y.typ == PICS.Word_t {
+		c.compare16(x, y)
+	} else {
+		if x.mode == inW {
+			if (rel == PICS.Eql) || (rel == PICS.Neq) {
+				x, y = y, x
 			} else {
-				Mark("expression", 9)
+				c.spill(&x)
 			}
+		}
+		if (rel == PICS.Eql || rel == PICS.Neq) && (x.mode == Variable) && (y.mode == Constant) && (y.a == 0) {
+			// MOVF sets the zero flag
+			c.emit(0x08, c.file(x.a))
 		} else {
-			Mark("expression", 10)
+			c.load(y)
+			if x.mode == Variable {
+				c.emit(0x02, c.file(x.a))
+			} else if x.mode == Constant {
+				c.emit(0x3C, x.a)
+			} else if x.mode != 0 {
+				c.Mark(10)
+			}
 		}
-	} else if xf == variable {
-		emit(0x08, x.a)
-	} else if xf == constant {
-		emit(0x30, xval)
+	}
+	if rel == PICS.Eql {
+		c.emit1(3, 2, 3)
+	} else if rel == PICS.Neq {
+		c.emit1(2, 2, 3)
+	} else if rel == PICS.Geq {
+		c.emit1(3, 0, 3)
 	} else {
-		Mark("expression", 10)
+		c.emit1(2, 0, 3)
 	}
 }
 
 // Logical expression handling
-func term() {
-	var x, y Object
-	var n, rel, yf, ya int
-
-	if sym == PICS.Ident {
-		x = this(PICS.Id)
-		PICS.Get(&sym)
-		if (sym >= PICS.Eql) && (sym <= PICS.Gtr) {
-			rel = sym
-			PICS.Get(&sym)
-			if sym == PICS.Ident {
-				y = this(PICS.Id)
-				PICS.Get(&sym)
-				yf = y.form
-				ya = y.a
-			} else if sym == PICS.Number {
-				yf = constant
-				ya = PICS.Val
-				PICS.Get(&sym)
-			}
-			if rel < PICS.Leq {
-				if yf == variable {
-					emit(0x08, ya)
-					emit(0x02, x.a)
-				} else if yf == constant {
-					if ya == 0 {
-						emit(0x08, x.a)
-					} else {
-						emit(0x30, ya)
-						emit(0x02, x.a)
-					}
-				}
-			} else {
-				emit(0x08, x.a)
-				if yf == variable {
-					emit(0x02, ya)
-				} else if (yf == constant) && (yf != 0) {
-					emit(0x60, ya)
-				}
+// A term is a bit test or a relation between two expressions
+func (c *Compiler) term() {
+	var obj Object
+	var x, y item
+	var n, rel int
+
+	if c.sym == PICS.Ident {
+		obj = c.this(c.sc.Id)
+		c.sc.Get(&c.sym)
+		obj = c.selector(obj, &n)
+		if n >= 0 || (!arith(c.sym) && !(c.sym >= PICS.Eql && c.sym <= PICS.Gtr) && c.sym != PICS.Lparen) {
+			// Bit test, x.n or x alone for x.0
+			if n < 0 {
+				n = 0
 			}
-			if rel == PICS.Eql {
-				emit1(3, 2, 3)
-			} else if rel == PICS.Neq {
-				emit1(2, 2, 3)
-			} else if (rel == PICS.Geq) || (rel == PICS.Leq) {
-				emit1(3, 0, 3)
-			} else if (rel == PICS.Lss) || (rel == PICS.Gtr) {
-				emit1(2, 0, 3)
+			c.emit1(3, n, c.file(c.testReg(obj)))
+			return
+		}
+		x = c.ident(obj, &x)
+	} else if c.sym == PICS.Not {
+		c.sc.Get(&c.sym)
+		if c.sym == PICS.Ident {
+			obj = c.this(c.sc.Id)
+			c.sc.Get(&c.sym)
+			obj = c.selector(obj, &n)
+			if n < 0 {
+				n = 0
 			}
+			c.emit1(2, n, c.file(c.testReg(obj)))
 		} else {
-			index(&n)
-			emit1(3, n, x.a)
-		}
-	} else if sym == PICS.Not {
-		PICS.Get(&sym)
-		if sym == PICS.Ident {
-			x = this(PICS.Id)
-			PICS.Get(&sym)
-			index(&n)
-			emit1(2, n, x.a)
-		} else {
-			Mark("term", 10)
+			c.Mark(10)
+		}
+		return
+	} else {
+		x = c.factor(&x)
+	}
+	x = c.chain(x)
+	if (c.sym >= PICS.Eql) && (c.sym <= PICS.Gtr) {
+		rel = c.sym
+		c.sc.Get(&c.sym)
+		y = c.factor(&x)
+		if arith(c.sym) {
+			c.spill(&x)
+			y = c.chain(y)
 		}
+		c.compare(rel, x, y)
 	} else {
-		Mark("term", 10)
+		c.Mark(29)
 	}
 }
 
 // Conditional expression for guarded statements
-func condition(link *int) {
+func (c *Compiler) condition(link *int) {
 	var L, L0, L1 int
 
-	term()
-	Code[Pc] = 0
-	L = Pc
-	Pc += 1
+	c.term()
+	L = c.jump(0)
 
-	if sym == PICS.And {
+	if c.sym == PICS.And {
 		for {
-			PICS.Get(&sym)
-			term()
-			Code[Pc] = L
-			L = Pc
-			Pc += 1
-			if sym != PICS.And {
+			c.sc.Get(&c.sym)
+			c.term()
+			L = c.jump(L)
+			if c.sym != PICS.And {
 				break
 			}
 		}
-	} else if sym == PICS.Or {
+	} else if c.sym == PICS.Or {
 		for {
-			PICS.Get(&sym)
-			term()
-			Code[Pc] = L
-			L = Pc
-			Pc += 1
-			if sym != PICS.Or {
+			c.sc.Get(&c.sym)
+			c.term()
+			L = c.jump(L)
+			if c.sym != PICS.Or {
 				break
 			}
 		}
-		L0 = Code[L]
-		Code[L] = 0
-		for {
-			if (Code[L0-1] / 0x400) == 6 {
-				Code[L0-1] += 0x400
-			} else {
-				Code[L0-1] -= 0x400
+		L0 = c.code[L]
+		c.code[L] = 0
+		// After an error in a term there may be no skip before its jump,
+		// or the jump may be at 0, the end of the chain
+		for L0 != 0 {
+			switch c.code[L0-1] / 0x400 {
+			case 6: // BTFSC
+				c.code[L0-1] += 0x400
+			case 7: // BTFSS
+				c.code[L0-1] -= 0x400
 			}
-			L1 = Code[L0]
-			Code[L0] = Pc + 0x2800
+			L1 = c.code[L0]
+			c.code[L0] = c.pc + 0x2800
+			c.rp = merge(c.rp, c.rpAt[L0])
 			L0 = L1
-			if L0 == 0 {
-				break
-			}
 		}
 	}
 	*link = L
 }
 
 // Fix up forward and backward jumps
-func fixup(L int, k int) {
+// Jumps to the current location bring their bank state along
+func (c *Compiler) fixup(L int, k int) {
 	var L1 int
 
 	for L != 0 {
-		L1 = Code[L]
-		Code[L] = k + 0x2800
+		L1 = c.code[L]
+		c.code[L] = k + 0x2800
+		if k == c.pc {
+			c.rp = merge(c.rp, c.rpAt[L])
+		}
 		L = L1
 	}
 }
 
 // Statement sequence
 // NOTE: Statement() is not a pointer indirection
-func StatSeq() {
-	Statement()
-	for sym == PICS.Semicolon {
-		PICS.Get(&sym)
-		Statement()
+func (c *Compiler) StatSeq() {
+	for {
+		c.Statement()
+		if !stmtStart(c.sym) && !stmtEnd(c.sym) {
+			c.Mark(26)
+			c.sync(follow[:]...)
+		}
+		if c.sym == PICS.Semicolon {
+			c.sc.Get(&c.sym)
+		} else if stmtStart(c.sym) {
+			// Missing semicolon, carry on with the next statement
+			c.Mark(20)
+		} else {
+			break
+		}
 	}
 }
 
 // Guarded statement block
 // NOTE: not actually called anywhere in original code, but if condition terminating
 // symbol is made a param, can be used for IF, ELSIF and WHILE blocks
-func Guarded(s int, L *int) {
-	condition(L)
-	if sym == s {
-		PICS.Get(&sym)
+func (c *Compiler) Guarded(s int, L *int) {
+	c.condition(L)
+	if c.sym == s {
+		c.sc.Get(&c.sym)
 	} else {
-		Mark("Guarded", 14)
+		c.Mark(14)
 	}
-	StatSeq()
+	c.StatSeq()
 }
 
 // Conditional Statements
-func IfStat() {
+func (c *Compiler) IfStat() {
 	var L0, L int
 
-	Guarded(PICS.Then, &L)
+	c.Guarded(PICS.Then, &L)
 	L0 = 0
-	for sym == PICS.Elsif {
-		Code[Pc] = L0
-		L0 = Pc
-		Pc += 1
-		fixup(L, Pc)
-		PICS.Get(&sym)
-		Guarded(PICS.Then, &L)
-	}
-	if sym == PICS.Else {
-		Code[Pc] = L0
-		L0 = Pc
-		Pc += 1
-		fixup(L, Pc)
-		PICS.Get(&sym)
-		StatSeq()
+	for c.sym == PICS.Elsif {
+		L0 = c.jump(L0)
+		c.rp = unreachable
+		c.fixup(L, c.pc)
+		c.line(c.sc.Pos)
+		c.sc.Get(&c.sym)
+		c.Guarded(PICS.Then, &L)
+	}
+	if c.sym == PICS.Else {
+		L0 = c.jump(L0)
+		c.rp = unreachable
+		c.fixup(L, c.pc)
+		c.sc.Get(&c.sym)
+		c.StatSeq()
 	} else {
-		fixup(L, Pc)
+		c.fixup(L, c.pc)
 	}
-	if sym == PICS.End {
-		PICS.Get(&sym)
+	if c.sym == PICS.End {
+		c.sc.Get(&c.sym)
 	} else {
-		Mark("IfStat", 15)
+		c.Mark(15)
 	}
-	fixup(L0, Pc)
+	c.fixup(L0, c.pc)
 }
 
 // Conditional Repetition: condition first
-func WhileStat() {
-	var L0, L int
-
-	L0 = Pc
-	Guarded(PICS.Do, &L)
-	emit(0x28, L0)
-	fixup(L, Pc)
-	for sym == PICS.Elsif {
-		PICS.Get(&sym)
-		Guarded(PICS.Do, &L)
-		emit(0x28, L0)
-		fixup(L, Pc)
-	}
-	if sym == PICS.End {
-		PICS.Get(&sym)
+func (c *Compiler) WhileStat() {
+	var L0, L, rp int
+
+	L0 = c.pc
+	rp = c.rp
+	c.Guarded(PICS.Do, &L)
+	c.setBank(rp)
+	c.emit(0x28, L0)
+	c.rp = unreachable
+	c.fixup(L, c.pc)
+	for c.sym == PICS.Elsif {
+		c.line(c.sc.Pos)
+		c.sc.Get(&c.sym)
+		c.Guarded(PICS.Do, &L)
+		c.setBank(rp)
+		c.emit(0x28, L0)
+		c.rp = unreachable
+		c.fixup(L, c.pc)
+	}
+	if c.sym == PICS.End {
+		c.sc.Get(&c.sym)
 	} else {
-		Mark("WhileStat", 16)
+		c.Mark(16)
 	}
 }
 
 // Conditional Repetition: condition last
-func RepeatStat() {
-	var L0, L int
-
-	L0 = Pc
-	StatSeq()
-	if sym == PICS.Until {
-		PICS.Get(&sym)
-		condition(&L)
-		if (Code[Pc-4]/0x100 == 3) && (Code[Pc-3]/0x100 == 8) &&
-			(Code[Pc-2] == 0x1D03) && (Code[Pc-4]%0x80 == Code[Pc-3]%0x100) {
-			Code[Pc-4] += 0x800
-			Code[Pc-3] = 0
-			Pc -= 2
-			L = Pc - 1
-		}
-		fixup(L, L0)
-	} else if sym == PICS.End {
-		PICS.Get(&sym)
-		emit(0x28, L0)
+func (c *Compiler) RepeatStat() {
+	var L0, L, L1, rp int
+
+	L0 = c.pc
+	rp = c.rp
+	c.StatSeq()
+	if c.sym == PICS.Until {
+		c.line(c.sc.Pos)
+		c.sc.Get(&c.sym)
+		c.condition(&L)
+		if (c.pc >= L0+4) && (c.code[c.pc-4]/0x100 == 3) && (c.code[c.pc-3]/0x100 == 8) &&
+			(c.code[c.pc-2] == 0x1D03) && (c.code[c.pc-4]%0x80 == c.code[c.pc-3]%0x100) {
+			c.code[c.pc-4] += 0x800
+			c.code[c.pc-3] = 0
+			c.pc -= 2
+			L = c.pc - 1
+			c.rpAt[L] = c.rp
+		}
+		if c.allIn(L, rp) {
+			c.fixup(L, L0)
+		} else {
+			// Go back via a jump that restores the bank of the loop head
+			L1 = c.jump(0)
+			c.rp = unreachable
+			c.fixup(L, c.pc)
+			c.setBank(rp)
+			c.emit(0x28, L0)
+			c.rp = unreachable
+			c.fixup(L1, c.pc)
+		}
+	} else if c.sym == PICS.End {
+		c.sc.Get(&c.sym)
+		c.setBank(rp)
+		c.emit(0x28, L0)
+		c.rp = unreachable
 	} else {
-		Mark("RepeatStat", 25)
+		c.Mark(25)
 	}
 }
 
 // Assignment Statement (new)
 // NOTE: factored out from Statement() vs original code
-func AssignStat(x Object) {
-	var w int
+func (c *Compiler) AssignStat(x Object) {
+	var w, pc0, typ int
+	var y item
 
-	PICS.Get(&sym)
-	if x.form != variable {
-		Mark("AssignStat", 2)
+	c.sc.Get(&c.sym)
+	if x.form != Variable && x != c.undef {
+		c.Mark(2)
 	}
-	expression()
-	w = Code[Pc-1]
+	if x.typ == PICS.Word_t {
+		y = c.factor(&y)
+		y = c.chain(y)
+		if !assignable(x.typ, y.typ) {
+			c.Mark(12)
+		}
+		c.store16(x.a, y)
+		return
+	}
+	pc0 = c.pc
+	typ = c.expression()
+	if c.pc == pc0 {
+		// Erroneous expression, no code
+		return
+	} else if !assignable(x.typ, typ) {
+		c.Mark(12)
+	}
+	w = c.code[c.pc-1]
 	if w == 0x3000 {
-		Code[Pc-1] = x.a + 0x180
-	} else if ((w / 0x100) <= 13) && (w%0x100 == x.a) {
-		Code[Pc-1] += 0x80
+		// MOVLW 0 becomes CLRF x
+		c.pc -= 1
+		c.emit(1, c.file(x.a)+0x80)
+	} else if ((w / 0x100) <= 13) && (w%0x100 == x.a%0x80) && c.inBank(x.a) {
+		c.code[c.pc-1] += 0x80
 	} else {
-		emit(0, x.a+0x80)
+		c.emit(0, c.file(x.a)+0x80)
+	}
+	c.clobber(x.a)
+}
+
+// Assignment to element i of array x (new)
+// The address is put into FSR after the expression, which may need FSR
+// itself
+func (c *Compiler) IndexAssign(x Object, i item) {
+	var y item
+
+	c.sc.Get(&c.sym)
+	y = c.factor(&y)
+	y = c.chain(y)
+	c.spill(&y)
+	x = c.element(x, i)
+	if y.mode == Constant && y.a == 0 {
+		c.emit(1, indf+0x80)
+	} else {
+		c.load(y)
+		c.emit(0, indf+0x80)
 	}
 }
 
 // Procedure Call Statement (new)
 // NOTE: factored out from Statement() vs original code
-func CallStat(x Object) {
-	if x.form != procedure {
-		Mark("CallStat", 3)
-	}
-	if sym == PICS.Lparen {
-		PICS.Get(&sym)
-		expression()
-		emit(0x20, x.a)
-		if sym == PICS.Rparen {
-			PICS.Get(&sym)
-		} else {
-			Mark("CallStat", 8)
-		}
+func (c *Compiler) CallStat(x Object) {
+	if x.form != Procedure && x != c.undef {
+		c.Mark(3)
+	} else if x.form == Procedure && x.typ != 0 {
+		c.Mark(40)
+	} else if x == c.isr {
+		c.Mark(53)
+	}
+	if c.sym == PICS.Lparen {
+		c.sc.Get(&c.sym)
+		c.actuals(x)
 	} else {
-		emit(0x20, x.a)
+		c.store(x, nil)
+		c.call(x.a)
 	}
 }
 
-func Operand1(cd int) {
+func (c *Compiler) Operand1(cd int) {
 	var x Object
 
-	if sym == PICS.Ident {
-		x = this(PICS.Id)
-		PICS.Get(&sym)
-		if x.form != variable {
-			Mark("Operand1", 2)
+	if c.sym == PICS.Ident {
+		x = c.this(c.sc.Id)
+		if x.form != Variable && x != c.undef {
+			c.Mark(2)
+		}
+		c.sc.Get(&c.sym)
+		x = c.designator(x)
+		if x.typ == PICS.Word_t {
+			c.update16(cd, x.a)
+		} else {
+			c.emit(cd, c.file(x.a)+0x80)
+			c.clobber(x.a)
 		}
-		emit(cd, x.a+0x80)
 	} else {
-		Mark("Operand1", 10)
+		c.Mark(10)
 	}
 }
 
-func Operand2(cd int) {
+func (c *Compiler) Operand2(cd int) {
 	var x Object
 	var n int
 
-	if sym == PICS.Ident {
-		x = this(PICS.Id)
-		PICS.Get(&sym)
-		if x.form != variable {
-			Mark("Operand2", 2)
+	if c.sym == PICS.Ident {
+		x = c.this(c.sc.Id)
+		if x.form != Variable && x != c.undef {
+			c.Mark(2)
+		}
+		c.sc.Get(&c.sym)
+		x = c.selector(x, &n)
+		if n < 0 {
+			n = 0
+		}
+		c.emit1(cd, n, c.file(x.a))
+		if x.a%0x80 == 3 && (n == 5 || n == 6) {
+			// User code switching banks
+			if c.rp < 0 || cd > 1 {
+				c.rp = unknown
+			} else {
+				c.rp = c.rp&^(1<<(n-5)) | cd<<(n-5)
+			}
 		}
-		index(&n)
-		emit1(cd, n, x.a)
 	} else {
-		Mark("Operand2", 10)
+		c.Mark(10)
 	}
 }
 
 // Statement
 // NOTE: renamed from Statement0
-func Statement() {
+func (c *Compiler) Statement() {
 	var x Object
 
-	switch sym {
+	// Temporaries of the previous statement are free
+	c.ntemp = 0
+	c.npairs = 0
+	c.line(c.sc.Pos)
+	switch c.sym {
 	case PICS.Ident:
-		x = this(PICS.Id)
-		PICS.Get(&sym)
-		if sym == PICS.Becomes {
-			AssignStat(x)
+		x = c.this(c.sc.Id)
+		c.sc.Get(&c.sym)
+		if c.sym == PICS.Lbrak {
+			c.sc.Get(&c.sym)
+			i := c.subscript(x)
+			if i.mode != Constant && x.form == Variable && x.size > 0 && c.sym == PICS.Becomes {
+				c.spill(&i)
+				c.IndexAssign(x, i)
+				break
+			}
+			x = c.element(x, i)
+		}
+		x = c.designator(x)
+		if c.sym == PICS.Becomes {
+			c.AssignStat(x)
 		} else {
-			CallStat(x)
+			c.CallStat(x)
 		}
 	case PICS.Inc:
-		PICS.Get(&sym)
-		Operand1(10)
+		c.sc.Get(&c.sym)
+		c.Operand1(10)
 	case PICS.Dec:
-		PICS.Get(&sym)
-		Operand1(3)
+		c.sc.Get(&c.sym)
+		c.Operand1(3)
 	case PICS.Rol:
-		PICS.Get(&sym)
-		Operand1(13)
+		c.sc.Get(&c.sym)
+		c.Operand1(13)
 	case PICS.Ror:
-		PICS.Get(&sym)
-		Operand1(12)
+		c.sc.Get(&c.sym)
+		c.Operand1(12)
 	case PICS.Op:
-		PICS.Get(&sym)
-		if sym == PICS.Not {
-			PICS.Get(&sym)
-			Operand2(0)
+		c.sc.Get(&c.sym)
+		if c.sym == PICS.Not {
+			c.sc.Get(&c.sym)
+			c.Operand2(0)
 		} else {
-			Operand2(1)
+			c.Operand2(1)
 		}
 	case PICS.Query:
-		PICS.Get(&sym)
-		if sym == PICS.Not {
-			PICS.Get(&sym)
-			Operand2(2)
+		c.sc.Get(&c.sym)
+		if c.sym == PICS.Not {
+			c.sc.Get(&c.sym)
+			c.Operand2(2)
 		} else {
-			Operand2(3)
+			c.Operand2(3)
 		}
-		emit(0x28, Pc-1)
+		c.emit(0x28, c.pc-1)
 	case PICS.Lparen:
-		PICS.Get(&sym)
-		StatSeq()
-		if sym == PICS.Rparen {
-			PICS.Get(&sym)
+		c.sc.Get(&c.sym)
+		c.StatSeq()
+		if c.sym == PICS.Rparen {
+			c.sc.Get(&c.sym)
 		} else {
-			Mark("Statement", 8)
+			c.Mark(8)
 		}
 	case PICS.If:
-		PICS.Get(&sym)
-		IfStat()
+		c.sc.Get(&c.sym)
+		c.IfStat()
 	case PICS.While:
-		PICS.Get(&sym)
-		WhileStat()
+		c.sc.Get(&c.sym)
+		c.WhileStat()
 	case PICS.Repeat:
-		PICS.Get(&sym)
-		RepeatStat()
+		c.sc.Get(&c.sym)
+		c.RepeatStat()
+	case PICS.Asm:
+		c.AsmStat()
 	}
 }
 
 // Procedure declarations
-func ProcDecl() {
-	var typ, partyp, restyp, pc0 int
+func (c *Compiler) ProcDecl() {
+	var typ, n, partyp, restyp, pc0 int
+	var isr bool
 	var obj Object
+	var params []Object
 	var name = make([]byte, 0, 16)
 
-	obj = IdList
+	obj = c.idList
 	partyp = 0
 	restyp = 0
-	pc0 = Pc
+	pc0 = c.pc
+	c.rp = 0
+	pos := c.sc.Pos
+
+	// Interrupt procedure, PROCEDURE* name
+	if c.sym == PICS.Ast {
+		isr = true
+		pc0 = c.interrupt()
+		c.sc.Get(&c.sym)
+	}
+	c.line(pos)
 
 	// Procedure name
-	if sym == PICS.Ident {
-		name = append(name, PICS.Id...)
-		PICS.Get(&sym)
+	if c.sym == PICS.Ident {
+		name = append(name, c.sc.Id...)
+		c.sc.Get(&c.sym)
 	} else {
-		Mark("ProcDecl", 10)
-	}
-
-	// Optional parens with optional argument
-	if sym == PICS.Lparen {
-		PICS.Get(&sym)
-		if (sym >= PICS.Int) && (sym <= PICS.Bool) {
-			partyp = sym - PICS.Int + 1
-			PICS.Get(&sym)
-			if sym == PICS.Ident {
-				enter(string(PICS.Id), variable, partyp, dc)
-				PICS.Get(&sym)
-				emit(0, dc+0x80)
-				dc += 1
-			} else {
-				Mark("ProcDecl", 10)
+		c.Mark(10)
+	}
+	c.proc = name
+	c.temps = nil
+	c.pairs = nil
+
+	// Optional parens with optional parameters, eg (INT a, b; SET s)
+	if c.sym == PICS.Lparen {
+		c.sc.Get(&c.sym)
+		for typeSym(c.sym) {
+			typ = c.sym - PICS.Int + 1
+			c.sc.Get(&c.sym)
+			if c.sym != PICS.Ident {
+				c.Mark(10)
+			}
+			for c.sym == PICS.Ident {
+				c.variable(c.sc.Id, typ, 0)
+				params = append(params, c.idList)
+				c.sc.Get(&c.sym)
+				if c.sym == PICS.Comma {
+					c.sc.Get(&c.sym)
+				}
+			}
+			if c.sym == PICS.Semicolon {
+				c.sc.Get(&c.sym)
 			}
 		}
-		if sym == PICS.Rparen {
-			PICS.Get(&sym)
+		if c.sym == PICS.Rparen {
+			c.sc.Get(&c.sym)
 		} else {
-			Mark("ProcDecl", 8)
+			c.Mark(8)
+		}
+	}
+	// The last parameter is passed in W, see actuals
+	if n := len(params); n > 0 {
+		partyp = params[0].typ
+		if params[n-1].typ != PICS.Word_t {
+			c.emit(0, c.file(params[n-1].a)+0x80)
 		}
 	}
 
 	// Optional result type
-	if sym == PICS.Colon {
-		PICS.Get(&sym)
-		if (sym >= PICS.Int) && (sym <= PICS.Bool) {
-			restyp = sym - PICS.Int + 1
-			PICS.Get(&sym)
+	if c.sym == PICS.Colon {
+		c.sc.Get(&c.sym)
+		if typeSym(c.sym) {
+			restyp = c.sym - PICS.Int + 1
+			if restyp == PICS.Word_t {
+				c.Mark(31)
+			}
+			c.sc.Get(&c.sym)
 		} else {
-			Mark("ProcDecl", 10)
+			c.Mark(10)
 		}
 	}
 
+	if isr && (len(params) > 0 || restyp != 0) {
+		c.Mark(52)
+	}
+
 	// Terminate procedure header
-	if sym == PICS.Semicolon {
-		PICS.Get(&sym)
+	if c.sym == PICS.Semicolon {
+		c.sc.Get(&c.sym)
 	} else {
-		Mark("ProcDecl", 20)
+		c.Mark(20)
 	}
 
 	// Variable declarations
-	for (sym >= PICS.Int) && (sym <= PICS.Bool) {
-		typ = sym - PICS.Int + 1
-		PICS.Get(&sym)
-		for sym == PICS.Ident {
-			enter(string(PICS.Id), variable, typ, dc)
-			dc += 1
-			PICS.Get(&sym)
-			if sym == PICS.Comma {
-				PICS.Get(&sym)
+	for typeSym(c.sym) || c.sym == PICS.Array {
+		typ, n = c.varType()
+		for c.sym == PICS.Ident {
+			c.variable(c.sc.Id, typ, n)
+			c.sc.Get(&c.sym)
+			if c.sym == PICS.Comma {
+				c.sc.Get(&c.sym)
 			}
 		}
-		if sym == PICS.Semicolon {
-			PICS.Get(&sym)
+		if c.sym == PICS.Semicolon {
+			c.sc.Get(&c.sym)
 		} else {
-			Mark("ProcDecl", 20)
+			c.Mark(20)
 		}
 	}
 
+	if isr {
+		c.save()
+	}
+
 	// Procedure body
-	if sym == PICS.Begin {
-		PICS.Get(&sym)
-		StatSeq()
+	if c.sym != PICS.Begin {
+		c.Mark(21)
+		c.sync(PICS.Begin, PICS.End, PICS.Proced)
+	}
+	if c.sym == PICS.Begin {
+		c.sc.Get(&c.sym)
+		c.StatSeq()
+	}
+	if c.sym == PICS.Return {
+		c.line(c.sc.Pos)
+		if restyp == 0 {
+			c.Mark(36)
+		}
+		c.sc.Get(&c.sym)
+		if typ = c.expression(); restyp != 0 && typ != restyp && typ != 0 {
+			c.Mark(37)
+		}
+	} else if restyp != 0 {
+		c.Mark(38)
+	}
+	if c.sym == PICS.End {
+		c.line(c.sc.Pos)
+	}
+	if isr {
+		c.restore()
 	} else {
-		Mark("ProcDecl", 21)
-	}
-	if sym == PICS.Return {
-		PICS.Get(&sym)
-		expression()
-	}
-	emit(0, 8)
-	if sym == PICS.End {
-		PICS.Get(&sym)
-		if sym == PICS.Ident {
-			if !(bytes.Compare(PICS.Id, name) == 0) {
-				Mark("ProcDecl", 22)
+		c.setBank(0)
+		c.emit(0, 8)
+	}
+	if c.sym == PICS.End {
+		c.sc.Get(&c.sym)
+		if c.sym == PICS.Ident {
+			if !(bytes.Compare(c.sc.Id, name) == 0) {
+				c.Mark(22)
 			}
-			PICS.Get(&sym)
+			c.sc.Get(&c.sym)
+		} else {
+			c.Mark(10)
+		}
+		if c.sym == PICS.Semicolon {
+			c.sc.Get(&c.sym)
 		} else {
-			Mark("ProcDecl", 10)
+			c.Mark(20)
 		}
 	} else {
-		Mark("ProcDecl", 18)
+		// Resume at the next procedure or the module body
+		c.Mark(18)
+		c.sync(PICS.Proced, PICS.Begin)
 	}
-	if sym == PICS.Semicolon {
-		PICS.Get(&sym)
+
+	// Clean up, keeping the scope for the map
+	kind := ProcBlock
+	if isr {
+		kind = InterruptBlock
+	}
+	c.keepScope(name, kind, pc0, params, obj)
+	c.idList = obj
+	c.enter(string(name), Procedure, restyp, pc0)
+	c.idList.ptyp = partyp
+	c.idList.params = params
+	if isr {
+		c.isr = c.idList
+		c.isrRuntime = len(c.rtRegs) > 0
+	}
+}
+
+// Configuration declaration, eg CONFIG FOSC = INTOSCIO, WDTE = OFF;
+// Fields not given keep the erased value of the device
+func (c *Compiler) ConfigDecl() {
+	var f *ConfigField
+	var v int
+
+	if c.config < 0 {
+		c.config = c.dev.Config.Default
+	}
+	for c.sym == PICS.Ident {
+		f = nil
+		for i := range c.dev.Config.Fields {
+			if c.dev.Config.Fields[i].Name == string(c.sc.Id) {
+				f = &c.dev.Config.Fields[i]
+			}
+		}
+		if f == nil {
+			c.Mark(55, c.sc.Id)
+		}
+		c.sc.Get(&c.sym)
+		if c.sym == PICS.Eql {
+			c.sc.Get(&c.sym)
+		} else {
+			c.Mark(58)
+		}
+		if c.sym == PICS.Number {
+			v = c.sc.Val
+		} else if c.sym == PICS.Ident && f != nil {
+			var ok bool
+			if v, ok = f.Values[string(c.sc.Id)]; !ok {
+				c.Mark(56, c.sc.Id, f.Name)
+			}
+		} else if c.sym != PICS.Ident {
+			c.Mark(7)
+		}
+		if f != nil {
+			v <<= bits.TrailingZeros(uint(f.Mask))
+			if v&^f.Mask != 0 {
+				c.Mark(57, f.Name)
+			}
+			c.config = c.config&^f.Mask | v&f.Mask
+		}
+		c.sc.Get(&c.sym)
+		if c.sym == PICS.Comma {
+			c.sc.Get(&c.sym)
+		}
+	}
+	if c.sym == PICS.Semicolon {
+		c.sc.Get(&c.sym)
 	} else {
-		Mark("ProcDecl", 20)
+		c.Mark(20)
 	}
+}
+
+// EEPROM declarations, eg EEPROM calib = 42; msg = (72, 105, 0);
+// Each name is a constant holding the EEPROM address of its first byte
+func (c *Compiler) EEPROMDecl() {
+	var data []int
 
-	// Clean up
-	IdList = obj
-	enter(string(name), procedure, restyp, pc0)
-	IdList.ptyp = partyp
+	for c.sym == PICS.Ident {
+		c.enter(string(c.sc.Id), Constant, PICS.Int_t, len(c.eeprom))
+		c.sc.Get(&c.sym)
+		if c.sym == PICS.Eql {
+			c.sc.Get(&c.sym)
+		} else {
+			c.Mark(5)
+		}
+		if c.sym == PICS.Lparen {
+			data = c.byteList()
+		} else {
+			data = []int{c.byteValue()}
+		}
+		if len(c.eeprom)+len(data) > c.dev.EEPROM.Size {
+			c.Mark(59, c.idList.name)
+		}
+		c.eeprom = append(c.eeprom, data...)
+		if c.sym == PICS.Semicolon {
+			c.sc.Get(&c.sym)
+		} else {
+			c.Mark(20)
+		}
+	}
 }
 
-func Module() {
-	var typ int
+func (c *Compiler) Module() {
+	var typ, n int
 	var name = make([]byte, 0, 16)
 
 	// Module header
-	if sym == PICS.Module {
-		PICS.Get(&sym)
-		if sym == PICS.Ident {
-			name = append(name, PICS.Id...)
-			PICS.Get(&sym)
+	if c.sym == PICS.Module {
+		c.sc.Get(&c.sym)
+		if c.sym == PICS.Ident {
+			name = append(name, c.sc.Id...)
+			c.sc.Get(&c.sym)
 		} else {
-			Mark("Module", 10)
+			c.Mark(10)
 		}
-		if sym == PICS.Semicolon {
-			PICS.Get(&sym)
+		if c.sym == PICS.Semicolon {
+			c.sc.Get(&c.sym)
 		} else {
-			Mark("Module", 20)
+			c.Mark(20)
 		}
 	}
 
+	// CONFIG Declarations
+	for c.sym == PICS.Config {
+		c.sc.Get(&c.sym)
+		c.ConfigDecl()
+	}
+
 	// CONST Declarations
-	if sym == PICS.Const {
-		PICS.Get(&sym)
-		for sym == PICS.Ident {
-			enter(string(PICS.Id), constant, 1, 0)
-			PICS.Get(&sym)
-			if sym == PICS.Eql {
-				PICS.Get(&sym)
-				if sym == PICS.Number {
-					IdList.a = PICS.Val
-					PICS.Get(&sym)
+	if c.sym == PICS.Const {
+		c.sc.Get(&c.sym)
+		for c.sym == PICS.Ident {
+			c.enter(string(c.sc.Id), Constant, 1, 0)
+			c.sc.Get(&c.sym)
+			if c.sym == PICS.Eql {
+				c.sc.Get(&c.sym)
+				if c.sym == PICS.Number {
+					c.idList.a = c.sc.Val
+					if c.sc.Val > 0xFFFF {
+						c.Mark(32)
+					} else if c.sc.Val > 0xFF {
+						c.idList.typ = PICS.Word_t
+					}
+					c.sc.Get(&c.sym)
 				} else {
-					Mark("Module", 7)
+					c.Mark(7)
 				}
 			} else {
-				Mark("Module", 5)
+				c.Mark(5)
 			}
-			if sym == PICS.Semicolon {
-				PICS.Get(&sym)
+			if c.sym == PICS.Semicolon {
+				c.sc.Get(&c.sym)
 			} else {
-				Mark("Module", 20)
+				c.Mark(20)
 			}
 		}
 	}
 
-	// Var Declarations: INT, BOOL, SET
-	for (sym >= PICS.Int) && (sym <= PICS.Bool) {
-		typ = sym - PICS.Int + 1
-		PICS.Get(&sym)
+	// EEPROM Declarations
+	if c.sym == PICS.EEPROM {
+		c.sc.Get(&c.sym)
+		c.EEPROMDecl()
+	}
+
+	// Var Declarations: INT, BOOL, SET, WORD and ARRAY n OF one of them,
+	// and TABLE declarations
+	for typeSym(c.sym) || c.sym == PICS.Array || c.sym == PICS.Table {
+		if c.sym == PICS.Table {
+			c.sc.Get(&c.sym)
+			c.TableDecl()
+			continue
+		}
+		typ, n = c.varType()
 		// May be a list of identifiers eg INT a, b, c
-		for sym == PICS.Ident {
-			enter(string(PICS.Id), variable, typ, dc)
-			dc += 1
-			PICS.Get(&sym)
-			if sym == PICS.Comma {
-				PICS.Get(&sym)
+		for c.sym == PICS.Ident {
+			c.variable(c.sc.Id, typ, n)
+			c.sc.Get(&c.sym)
+			if c.sym == PICS.Comma {
+				c.sc.Get(&c.sym)
 			}
 		}
 		// Optional semicolon after var declaration?
-		if sym == PICS.Semicolon {
-			PICS.Get(&sym)
+		if c.sym == PICS.Semicolon {
+			c.sc.Get(&c.sym)
 		}
 	}
 
 	// PROCEDURE Declarations
-	for sym == PICS.Proced {
-		PICS.Get(&sym)
-		ProcDecl()
+	for c.sym != PICS.Begin && c.sym != PICS.End && c.sym != PICS.Eof {
+		if c.sym == PICS.Proced {
+			c.sc.Get(&c.sym)
+			c.ProcDecl()
+		} else {
+			c.Mark(21)
+			c.sync(PICS.Proced, PICS.Begin, PICS.End)
+		}
 	}
 
-	if Pc > 1 {
-		Code[0] = Pc + 0x2800
+	if c.pc > 1 {
+		c.code[0] = c.pc + 0x2800
 	} else {
-		Pc = 0
+		c.pc = 0
 	}
 
-	// Module body
-	if sym == PICS.Begin {
-		PICS.Get(&sym)
-		StatSeq()
+	// Module body, entered from reset in bank 0
+	c.rp = 0
+	c.proc = name
+	c.temps = nil
+	c.pairs = nil
+	body := c.pc
+	if c.sym == PICS.Begin {
+		c.sc.Get(&c.sym)
+		c.StatSeq()
+	}
+	n = len(c.blocks)
+	c.link()
+	end := c.pc
+	if len(c.blocks) > n {
+		end = c.blocks[n].Addr
 	}
+	c.blocks = append(c.blocks[:n], append([]Block{{Name: string(name), Kind: ModuleBlock, Addr: body, Size: end - body}}, c.blocks[n:]...)...)
+	c.module = name
 
-	if sym == PICS.End {
-		PICS.Get(&sym)
-		if !(bytes.Compare(PICS.Id, name) == 0) {
-			Mark("Module", 22)
+	if c.sym == PICS.End {
+		c.sc.Get(&c.sym)
+		if !(bytes.Compare(c.sc.Id, name) == 0) {
+			c.Mark(22)
 		}
 	} else {
-		Mark("Module", 18)
+		c.Mark(19)
 	}
 }
 
+// Set up a compiler for a device, predeclaring its registers
+func NewCompiler(dev *Device) *Compiler {
+	c := new(Compiler)
+	c.dev = dev
+	c.undef = new(ObjDesc)
+	c.banks = dev.Banks()
+	for _, reg := range dev.SFRs {
+		c.enter(reg.Name, Variable, PICS.Set_t, reg.Addr)
+	}
+	c.universe = c.idList
+	return c
+}
 
 // Entry point for module
-func Compile(reader *bufio.Reader) {
-	IdList = IdList0
-	PICS.Init(reader)
-	Pc = 1
-	dc = 0x20
-	Err = false
-	PICS.Get(&sym)
-	Module()
-	fmt.Printf("Errors: %d\n", errs)
+// All state is reset, so a Compiler can be used for several modules in turn
+func (c *Compiler) Compile(reader io.Reader) (*Result, error) {
+	c.vectorJump = false
+	res, err := c.compile(reader)
+	if c.vectorJump {
+		// The interrupt procedure comes after other procedures, the module
+		// is compiled again with the interrupt vector kept free
+		res, err = c.compile(io.MultiReader(bytes.NewReader(res.Source), reader))
+	}
+	return res, err
+}
+
+// Compile the module from reader
+func (c *Compiler) compile(reader io.Reader) (*Result, error) {
+	c.idList = c.universe
+	var src bytes.Buffer
+	c.sc = PICS.NewScanner(io.TeeReader(reader, &src))
+	c.code = make([]int, c.dev.codeSize())
+	c.rpAt = make([]int, c.dev.codeSize())
+	c.rp = 0
+	c.pc = 1
+	if c.vectorJump {
+		c.pc = vector + 1
+	}
+	c.dc = c.dev.RAMStart
+	c.top = c.dev.RAMEnd
+	c.isr = nil
+	c.isrRuntime = false
+	c.config = -1
+	c.eeprom = nil
+	c.errs = 0
+	c.diags = nil
+	c.rtRegs = nil
+	c.rtCalls = [nRoutines][]int{}
+	c.tables = nil
+	c.data = nil
+	c.lines = nil
+	c.blocks = nil
+	c.module = nil
+	c.names = make(map[int]string)
+	c.internal = nil
+	c.regPc = -1
+	c.sc.Get(&c.sym)
+	c.Module()
+
+	res := new(Result)
+	res.Code = append([]int(nil), c.code[:c.pc]...)
+	for obj := c.idList; obj != c.universe; obj = obj.next {
+		res.Symbols = append(res.Symbols, symbol(obj))
+	}
+	res.Data = c.data
+	res.Config = c.config
+	res.EEPROM = c.eeprom
+	res.Lines = c.lines
+	res.Names = c.names
+	res.Source = src.Bytes()
+	res.Module = string(c.module)
+	res.Blocks = c.blocks
+	res.Internal = c.internal
+	res.Diagnostics = c.diags
+	res.Errors = c.errs
+	res.Usage = Usage{c.pc, c.dev.codeSize(), c.dc - c.dev.RAMStart + c.dev.RAMEnd - c.top, c.dev.RAMEnd - c.dev.RAMStart + 1}
+	if c.errs > 0 {
+		return res, fmt.Errorf("%d error(s)", c.errs)
+	}
+	return res, nil
+}
+
+// Configuration word and EEPROM contents, at the start of a listing
+func (r *Result) header(w io.Writer) {
+	if r.Config >= 0 {
+		fmt.Fprintf(w, "Configuration word: %#.4x\n\n", r.Config)
+	}
+	if len(r.EEPROM) > 0 {
+		fmt.Fprintf(w, "EEPROM:")
+		for i, b := range r.EEPROM {
+			if i%8 == 0 {
+				fmt.Fprintf(w, "\n%#.2x ", i)
+			}
+			fmt.Fprintf(w, " %#.2x", b)
+		}
+		fmt.Fprintf(w, "\n\n")
+	}
 }
 
 // Generate listing
-func Decode(w io.Writer) {
-   var i, u, v int
-   var obj Object
-   
-   // Print symbols at module scope
-   fmt.Fprintf(w, "Symbols:\n")
-   obj = IdList
-   for obj != IdList0 {
-      fmt.Fprintf(w, "%#.2x %s %s %s\n", obj.a, forms[obj.form], types[obj.typ], obj.name)
-      obj = obj.next
-   }
-   // Generate code listing from memory contents
-   fmt.Fprintf(w, "\nAddr  Opcode Source\n")
-   for i = 0; i < Pc; i += 1 {
-      u = Code[i]
-      fmt.Fprintf(w, "%#.3x %#.4x ", i, u)
-      v = u / 0x1000
-      u = u % 0x1000
-      switch v {
-         case 0:
-            if u == 8 {
-               fmt.Fprintf(w, "RET\n")
-            } else {
-               fmt.Fprintf(w, "%s %#.2x,%s\n", table0[u/0x100], u%0x80, regs[(u/0x80)%2])
-            }
-         case 1:
-            fmt.Fprintf(w, "%s %#.2x.%d\n", table1[u/0x400], u%0x80, (u/0x80)%8)
-         case 2:
-            fmt.Fprintf(w, "%s %#.3x\n", table2[u/0x800], u%0x100)
-         case 3:
-            fmt.Fprintf(w, "%s %#.2x\n", table3[u/0x100], u%0x100)
-      }
-   }
-}
-   
-// Run once on startup
-func init() {
-	Err = false
-	errs = 0
-	undef = new(ObjDesc)
-   // PIC16F688 SFRs
-   // NOTE: 7-bit addresses only. Bank switching done by user
-   enter("INDF", variable, PICS.Set_t, 0x00)
-	enter("TMR0", variable, PICS.Set_t, 0x01)
-   enter("PCL", variable, PICS.Set_t, 0x02)
-	enter("STATUS", variable, PICS.Set_t, 0x03)
-   enter("FSR", variable, PICS.Set_t, 0x04)
-	enter("PORTA", variable, PICS.Set_t, 0x05); enter("TRISA", variable, PICS.Set_t, 0x05)
-	enter("PORTC", variable, PICS.Set_t, 0x07); enter("TRISC", variable, PICS.Set_t, 0x07)
-   enter("PCLATH", variable, PICS.Set_t, 0x0A)
-   enter("INTCON", variable, PICS.Set_t, 0x0B)
-   enter("PIR1", variable, PICS.Set_t, 0x0C); enter("PIE1", variable, PICS.Set_t, 0x0C)
-   enter("TMR1L", variable, PICS.Set_t, 0x0E); enter("PCON", variable, PICS.Set_t, 0x0E)
-   enter("TMR1H", variable, PICS.Set_t, 0x0F); enter("OSCCON", variable, PICS.Set_t, 0x0F)
-   enter("T1CON", variable, PICS.Set_t, 0x10); enter("OSCTUNE", variable, PICS.Set_t, 0x10)
-   enter("BAUDCTL", variable, PICS.Set_t, 0x11); enter("ANSEL", variable, PICS.Set_t, 0x11)
-   enter("SPBRGH", variable, PICS.Set_t, 0x12);
-   enter("SPBRG", variable, PICS.Set_t, 0x13);
-   enter("RCREG", variable, PICS.Set_t, 0x14);
-   enter("TXREG", variable, PICS.Set_t, 0x15); enter("WPUA", variable, PICS.Set_t, 0x15)
-   enter("TXSTA", variable, PICS.Set_t, 0x16); enter("IOCA", variable, PICS.Set_t, 0x16)
-   enter("RCSTA", variable, PICS.Set_t, 0x17); enter("EEDATH", variable, PICS.Set_t, 0x17)
-   enter("WDTCON", variable, PICS.Set_t, 0x18); enter("EEADRH", variable, PICS.Set_t, 0x18)
-   enter("CMCON0", variable, PICS.Set_t, 0x19); enter("VRCON", variable, PICS.Set_t, 0x19)
-   enter("CMCON1", variable, PICS.Set_t, 0x1A); enter("EEDAT", variable, PICS.Set_t, 0x1A)
-   enter("EEADR", variable, PICS.Set_t, 0x1B)
-   enter("EECON1", variable, PICS.Set_t, 0x1C)
-   enter("EECON2", variable, PICS.Set_t, 0x1D)
-   enter("ADRESH", variable, PICS.Set_t, 0x1E); enter("ADRESL", variable, PICS.Set_t, 0x1E)
-   enter("ADCON0", variable, PICS.Set_t, 0x1F); enter("ADCON1", variable, PICS.Set_t, 0x1F)
-   
-	IdList0 = IdList
+func (r *Result) Decode(w io.Writer) {
+	r.header(w)
+	// Print symbols at module scope
+	fmt.Fprintf(w, "Symbols:\n")
+	for _, obj := range r.Symbols {
+		fmt.Fprintf(w, "%#.2x %s %s %s\n", obj.Addr, forms[obj.Form], obj.typeName(), obj.Name)
+	}
+	// Generate code listing from memory contents, tables as data, each
+	// source line above its code
+	procs := make(map[int]string)
+	for _, obj := range r.Symbols {
+		if obj.Form == Procedure {
+			procs[obj.Addr] = obj.Name
+		}
+	}
+	var at int
+	reg := func(f int) string {
+		if n, ok := r.Names[at]; ok {
+			return n
+		}
+		return fmt.Sprintf("%#.2x", f)
+	}
+	label := func(k int) string {
+		if n, ok := procs[k]; ok {
+			return n
+		}
+		return fmt.Sprintf("%#.3x", k)
+	}
+	src := bytes.Split(bytes.TrimRight(r.Source, "\n"), []byte("\n"))
+	if len(r.Source) == 0 {
+		src = nil
+	}
+	// Lines up to n not shown yet, or line n again if the code goes back
+	// to it
+	shown, last := 0, 0
+	show := func(n int) {
+		if n <= shown && n > 0 && n != last {
+			fmt.Fprintf(w, "%5d  %s\n", n, bytes.TrimRight(src[n-1], "\r"))
+		}
+		for ; shown < n && shown < len(src); shown += 1 {
+			fmt.Fprintf(w, "%5d  %s\n", shown+1, bytes.TrimRight(src[shown], "\r"))
+		}
+		last = n
+	}
+
+	fmt.Fprintf(w, "\nAddr  Opcode Source\n")
+	ln := 0
+	for i, u := range r.Code {
+		for ; ln < len(r.Lines) && r.Lines[ln].Addr <= i; ln += 1 {
+			if n := r.Lines[ln].Pos.Line; n > 0 {
+				show(n)
+			} else {
+				fmt.Fprintf(w, "       (runtime)\n")
+			}
+		}
+		if n, ok := procs[i]; ok {
+			fmt.Fprintf(w, "%s:\n", n)
+		}
+		at = i
+		if r.isData(i) {
+			fmt.Fprintf(w, "%#.3x %#.4x DT     %#.2x\n", i, u, u%0x100)
+		} else {
+			fmt.Fprintf(w, "%#.3x %#.4x %s\n", i, u, decode(u, reg, label))
+		}
+	}
+	show(len(src))
+}
+
+// Does program memory address a hold table data?
+func (r *Result) isData(a int) bool {
+	for _, d := range r.Data {
+		if a >= d.Lo && a <= d.Hi {
+			return true
+		}
+	}
+	return false
+}
+
+// Decode a single instruction
+func Disasm(u int) string {
+	return decode(u, func(f int) string { return fmt.Sprintf("%#.2x", f) },
+		func(k int) string { return fmt.Sprintf("%#.3x", k) })
+}
+
+// Decode instruction u, reg names register f and label names branch target k
+// Returns "" if u is no instruction
+func decode(u int, reg func(f int) string, label func(k int) string) string {
+	v := u / 0x1000
+	u = u % 0x1000
+	switch v {
+	case 0:
+		switch {
+		case u == 8:
+			return "RETURN"
+		case u == 9:
+			return "RETFIE"
+		case u == 0x63:
+			return "SLEEP"
+		case u == 0x64:
+			return "CLRWDT"
+		case u&^0x60 == 0:
+			return "NOP"
+		case u/0x80 == 2:
+			return "CLRW"
+		case u < 0x80:
+			return ""
+		}
+		return fmt.Sprintf("%s %s,%s", table0[u/0x100], reg(u%0x80), regs[(u/0x80)%2])
+	case 1:
+		return fmt.Sprintf("%s %s.%d", table1[u/0x400], reg(u%0x80), (u/0x80)%8)
+	case 2:
+		return fmt.Sprintf("%s %s", table2[u/0x800], label(u%0x800))
+	case 3:
+		if table3[u/0x100] == "" {
+			return ""
+		}
+		return fmt.Sprintf("%s %#.2x", table3[u/0x100], u%0x100)
+	}
+	return ""
 }
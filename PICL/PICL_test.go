@@ -0,0 +1,290 @@
+package PICL
+
+import (
+	"fmt"
+	"picl-go/PICS"
+	"picl-go/sim"
+	"strings"
+	"testing"
+)
+
+// Compile src for the named device
+func compile(t *testing.T, device string, src string) *Result {
+	t.Helper()
+	dev, err := LoadDevice(device)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res, _ := NewCompiler(dev).Compile(strings.NewReader(src))
+	return res
+}
+
+// Codes of the errors reported
+func errCodes(res *Result) []int {
+	var codes []int
+	for _, d := range res.Diagnostics {
+		if d.Severity == Error {
+			codes = append(codes, d.Code)
+		}
+	}
+	return codes
+}
+
+// A procedure of n assignments, two words each, and a module body
+// calling it, put down after it
+func longModule(n int) string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "MODULE Long;\n  INT x;\n  PROCEDURE P;\n  BEGIN\n    x := 0")
+	for i := 0; i < n; i += 1 {
+		fmt.Fprintf(&b, ";\n    x := %d", i%200+1)
+	}
+	fmt.Fprintf(&b, "\n  END P;\nBEGIN\n  P\nEND Long.\n")
+	return b.String()
+}
+
+// GOTO and CALL only reach the first 2K page, longer programs are rejected
+// even where the device has more program memory
+func TestProgramMemory(t *testing.T) {
+	res := compile(t, "16F688", longModule(1000))
+	if res.Errors != 0 {
+		t.Fatalf("%d words: errors %v", len(res.Code), errCodes(res))
+	}
+	for _, b := range res.Blocks {
+		if u := res.Code[0]; b.Kind == ModuleBlock && u != 0x2800+b.Addr {
+			t.Errorf("word 0 is %#.4x, want GOTO %#.3x", u, b.Addr)
+		}
+	}
+
+	res = compile(t, "16F688", longModule(1100))
+	if codes := errCodes(res); len(codes) != 1 || codes[0] != 27 {
+		t.Errorf("%d words: errors %v, want [27]", len(res.Code), codes)
+	}
+	if res.Usage.ProgSize != 0x800 {
+		t.Errorf("usable program memory %#x, want 0x800", res.Usage.ProgSize)
+	}
+
+	res = compile(t, "16F84A", longModule(600))
+	if codes := errCodes(res); len(codes) != 1 || codes[0] != 27 {
+		t.Errorf("16F84A, %d words: errors %v, want [27]", len(res.Code), codes)
+	}
+}
+
+// Assignments and arguments follow the same rule, see assignable
+var assignTests = []struct {
+	stat  string
+	codes []int
+}{
+	{"b := 1", nil},
+	{"P(1)", nil},
+	{"b := s; s := i; i := b", nil},
+	{"P(s); Q(b); R(i)", nil},
+	{"w := i; w := 300", nil},
+	{"i := w", []int{12}},
+	{"Q(w)", []int{35}},
+	{"w := s", []int{12}},
+	{"R(b)", []int{35}},
+}
+
+func TestAssignable(t *testing.T) {
+	for _, tt := range assignTests {
+		src := fmt.Sprintf(`MODULE A;
+  INT i; BOOL b; SET s; WORD w;
+  PROCEDURE P(BOOL x); BEGIN b := x END P;
+  PROCEDURE Q(INT x); BEGIN i := x END Q;
+  PROCEDURE R(WORD x); BEGIN w := x END R;
+BEGIN
+  %s
+END A.`, tt.stat)
+		res := compile(t, "16F688", src)
+		if codes := errCodes(res); fmt.Sprint(codes) != fmt.Sprint(tt.codes) {
+			t.Errorf("%s: errors %v, want %v", tt.stat, codes, tt.codes)
+		}
+	}
+}
+
+// The runtime registers are shared, so the interrupt procedure and the
+// rest of the module cannot both multiply or divide
+func TestInterruptRuntime(t *testing.T) {
+	for _, tt := range []struct {
+		isr, body string
+		codes     []int
+	}{
+		{"n := n MOD 10", "x := 1", nil},
+		{"INC n", "x := x * 3", nil},
+		{"n := n MOD 10", "x := x * 3", []int{63}},
+		{"n := n / 2", "x := x / 3; x := x MOD 3", []int{63, 63}},
+	} {
+		src := fmt.Sprintf(`MODULE I;
+  INT n, x;
+  PROCEDURE* Tick;
+  BEGIN %s
+  END Tick;
+BEGIN
+  x := 7; %s
+END I.`, tt.isr, tt.body)
+		res := compile(t, "16F688", src)
+		if codes := errCodes(res); fmt.Sprint(codes) != fmt.Sprint(tt.codes) {
+			t.Errorf("%s / %s: errors %v, want %v", tt.isr, tt.body, codes, tt.codes)
+		}
+	}
+}
+
+// Each source line comes once in the listing, unless the code goes back
+// to it
+func TestListingLines(t *testing.T) {
+	res := compile(t, "16F688", "MODULE M;\n  INT x, y;\nBEGIN\n  x := 7; y := x * 3 END M.\n")
+	var b strings.Builder
+	res.Decode(&b)
+	if n := strings.Count(b.String(), "END M."); n != 1 {
+		t.Errorf("last line listed %d times, want once:\n%s", n, b.String())
+	}
+}
+
+// ASM blocks start in the bank of their first register and report
+// registers outside the bank selected. END ends a block only at the start
+// of a line
+func TestAsmBanks(t *testing.T) {
+	for _, tt := range []struct {
+		text  string
+		codes []int
+		code  []int // code of the block, after x := 3
+	}{
+		{"MOVWF x", nil, []int{0x00A0}},
+		{"MOVWF TRISA\n  BCF STATUS, 5\n  MOVWF x", nil, []int{0x1683, 0x0085, 0x1283, 0x00A0}},
+		{"BSF STATUS, 5\n  CLRF TRISA", nil, []int{0x1683, 0x0185}},
+		{"MOVWF x\n  MOVWF TRISA", []int{64}, nil},
+		{"MOVWF TRISA\n  MOVWF x", []int{64}, nil},
+		{"L: GOTO L ; END\n  GOTO L", nil, []int{0x2802, 0x2802}},
+	} {
+		src := fmt.Sprintf("MODULE A;\n  INT x;\nBEGIN\n  x := 3;\n  ASM\n  %s\n  END\nEND A.", tt.text)
+		res := compile(t, "16F688", src)
+		if codes := errCodes(res); fmt.Sprint(codes) != fmt.Sprint(tt.codes) {
+			t.Errorf("%q: errors %v, want %v", tt.text, codes, tt.codes)
+		} else if tt.codes == nil && fmt.Sprintf("%#x", res.Code[2:]) != fmt.Sprintf("%#x", tt.code) {
+			t.Errorf("%q: code %#x, want %#x", tt.text, res.Code[2:], tt.code)
+		}
+	}
+}
+
+// Syntax errors are reported and compilation goes on to the end
+var recoveryTests = []string{
+	"IF OR b THEN !~b END",
+	"WHILE x >= y IF OR b DO x := 1 END",
+	"IF AND b THEN x := 1 END",
+	"IF b OR OR b THEN x := 1 END",
+	"IF OR OR OR b THEN END",
+	"REPEAT x := 1 UNTIL OR b",
+	"WHILE OR b DO x := 1 ELSIF OR b DO x := 2 END",
+	"x := 1 y := 2; IF b THEN x := 3 END",
+}
+
+func TestRecovery(t *testing.T) {
+	for _, stat := range recoveryTests {
+		res := compile(t, "16F688", fmt.Sprintf("MODULE R;\n  INT x, y; BOOL b;\nBEGIN\n  %s\nEND R.", stat))
+		if res.Errors == 0 {
+			t.Errorf("%s: no errors", stat)
+		}
+	}
+}
+
+// The variables of the map, with the registers of the compiler, add up
+// to the RAM used
+func TestMapRAM(t *testing.T) {
+	res := compile(t, "16F688", mpasmSrc)
+	n := 0
+	for _, v := range res.variables() {
+		size := 1
+		if v.Typ == PICS.Word_t {
+			size = 2
+		}
+		if v.Len > 0 {
+			size *= v.Len
+		}
+		n += size
+	}
+	if n != res.Usage.RAM {
+		t.Errorf("variables of %d bytes, %d bytes of RAM used", n, res.Usage.RAM)
+	}
+	var b strings.Builder
+	res.MapFile(&b)
+	for _, s := range []string{"_saveW           (compiler)", "_rtA             (compiler)"} {
+		if !strings.Contains(b.String(), s) {
+			t.Errorf("%q missing in the map", s)
+		}
+	}
+}
+
+// Constants above 65535 do not fit a WORD
+func TestWordConstants(t *testing.T) {
+	for _, tt := range []struct {
+		stat  string
+		codes []int
+	}{
+		{"w := 65535; w := w + 65535; P(65535)", nil},
+		{"w := 65536", []int{32}},
+		{"w := w + 70000", []int{32}},
+		{"w := w - 65536", []int{32}},
+		{"P(65536)", []int{32}},
+		{"IF w = 65536 THEN w := 0 END", []int{32}},
+		{"i := 256", []int{32}},
+	} {
+		src := fmt.Sprintf(`MODULE C;
+  WORD w; INT i;
+  PROCEDURE P(WORD v); BEGIN w := v END P;
+BEGIN
+  %s
+END C.`, tt.stat)
+		res := compile(t, "16F688", src)
+		if codes := errCodes(res); fmt.Sprint(codes) != fmt.Sprint(tt.codes) {
+			t.Errorf("%s: errors %v, want %v", tt.stat, codes, tt.codes)
+		}
+	}
+
+	res := compile(t, "16F688", "MODULE C;\n  CONST K = 65536;\nBEGIN\nEND C.")
+	if codes := errCodes(res); fmt.Sprint(codes) != "[32]" {
+		t.Errorf("CONST K = 65536: errors %v, want [32]", codes)
+	}
+}
+
+// The interrupt procedure may come after the procedures it calls, it is
+// then reached by a GOTO at the vector
+func TestLateInterrupt(t *testing.T) {
+	res := compile(t, "16F688", `MODULE L;
+  INT n, x;
+  PROCEDURE Count;
+  BEGIN INC n; x := n; x := x + 1
+  END Count;
+  PROCEDURE* Tick;
+  BEGIN Count
+  END Tick;
+BEGIN
+  n := 0; !INTCON.7;
+  REPEAT x := n UNTIL n = 3
+END L.`)
+	if res.Errors != 0 {
+		t.Fatalf("errors %v", errCodes(res))
+	}
+	for _, b := range res.Blocks {
+		if u := res.Code[vector]; b.Kind == InterruptBlock && u != 0x2800+b.Addr {
+			t.Errorf("word %#.3x is %#.4x, want GOTO %#.3x", vector, u, b.Addr)
+		}
+	}
+
+	dev, _ := LoadDevice("16F688")
+	cpu := sim.New(res.Code, dev.Banks(), nil)
+	for i := 0; i < 20; i += 1 {
+		if cpu.Run(50); cpu.Halted() {
+			break
+		}
+		// The interrupt procedure sets GIE again with RETFIE
+		cpu.Interrupt()
+	}
+	if !cpu.Halted() || cpu.Reg(0x20) != 3 {
+		t.Errorf("n = %d after the interrupts, halted %v, want 3", cpu.Reg(0x20), cpu.Halted())
+	}
+
+	res = compile(t, "16F688", "MODULE M;\n  PROCEDURE* A; BEGIN END A;\n  PROCEDURE* B; BEGIN END B;\nBEGIN\nEND M.")
+	if codes := errCodes(res); fmt.Sprint(codes) != "[50]" {
+		t.Errorf("two interrupt procedures: errors %v, want [50]", codes)
+	}
+}
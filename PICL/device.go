@@ -0,0 +1,249 @@
+/*
+device.go: Descriptions of the target microcontrollers
+Notes:
+1. Devices are described in small text files, one declaration per line:
+     device   PIC16F688         name
+     progsize 0x1000            words of program memory
+     ram      0x20 0x7F         general purpose registers for variables
+     sfr      TRISA 0x085       predeclared register, full 9-bit address
+     shared   0x70 0x7F         registers common to all banks
+     config   0x2007 0x3FFF     configuration word address and erased value
+     eeprom   0x2100 256        data EEPROM address in the HEX file and size
+     field    WDTE 0x0008 OFF=0 ON=1
+                                configuration bits and their symbolic values
+   Numbers are decimal or hex (0x..), # starts a comment
+2. The descriptions in devices/ are built in and selected by name
+*/
+
+package PICL
+
+import (
+	"bufio"
+	"embed"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+//go:embed devices/*.dev
+var builtin embed.FS
+
+// Register is a predeclared special function register
+type Register struct {
+	Name string
+	Addr int
+}
+
+// Range of register addresses within a bank
+type Range struct {
+	Lo, Hi int
+}
+
+// ConfigField is a group of bits in the configuration word
+// Values are given right aligned, i.e. not shifted into place by Mask
+type ConfigField struct {
+	Name   string
+	Mask   int
+	Values map[string]int
+}
+
+// ConfigWord describes the layout of the configuration word
+type ConfigWord struct {
+	Addr    int
+	Default int
+	Fields  []ConfigField
+}
+
+// DataEEPROM gives the size of the data EEPROM and where its contents go
+// in the HEX file, one byte per word
+type DataEEPROM struct {
+	Addr int
+	Size int
+}
+
+// Device describes what the compiler needs to know about a target
+type Device struct {
+	Name     string
+	ProgSize int // words of program memory
+	RAMStart int // first general purpose register
+	RAMEnd   int // last general purpose register
+	SFRs     []Register
+	Shared   []Range // besides the core registers
+	Config   ConfigWord
+	EEPROM   DataEEPROM
+}
+
+// Core registers, mapped into all banks of every mid-range device
+var core = [...]int{0x00, 0x02, 0x03, 0x04, 0x0A, 0x0B}
+
+// Does accessing register a depend on the bank bits?
+func (d *Device) Banked(a int) bool {
+	f := a % 0x80
+	for _, r := range core {
+		if f == r {
+			return false
+		}
+	}
+	for _, r := range d.Shared {
+		if f >= r.Lo && f <= r.Hi {
+			return false
+		}
+	}
+	return true
+}
+
+// Words of program memory the compiler can use. GOTO and CALL are put
+// down without setting PCLATH<4:3>, so they only reach the first 2K page
+func (d *Device) codeSize() int {
+	if d.ProgSize > 0x800 {
+		return 0x800
+	}
+	return d.ProgSize
+}
+
+// Number of register banks in use
+func (d *Device) Banks() int {
+	n := 2
+	for _, reg := range d.SFRs {
+		if reg.Addr >= 0x100 {
+			n = 4
+		}
+	}
+	return n
+}
+
+// Names of the built in devices
+func Devices() []string {
+	var names []string
+
+	files, _ := builtin.ReadDir("devices")
+	for _, f := range files {
+		names = append(names, strings.TrimSuffix(f.Name(), ".dev"))
+	}
+	return names
+}
+
+// Load a device description by name (16F688, PIC16F688) or from a file
+func LoadDevice(name string) (*Device, error) {
+	var r io.ReadCloser
+	var err error
+
+	if filepath.Ext(name) == ".dev" {
+		r, err = os.Open(name)
+	} else {
+		r, err = builtin.Open("devices/" + strings.TrimPrefix(strings.ToUpper(name), "PIC") + ".dev")
+		if err != nil {
+			return nil, fmt.Errorf("unknown device %s, known devices are %s", name, strings.Join(Devices(), ", "))
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+
+	dev, err := ReadDevice(r)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", name, err)
+	}
+	return dev, nil
+}
+
+// Parser state, the first error sticks
+type devParser struct {
+	err error
+}
+
+func (p *devParser) num(s string) int {
+	n, err := strconv.ParseInt(s, 0, 32)
+	if err != nil && p.err == nil {
+		p.err = fmt.Errorf("bad number %s", s)
+	}
+	return int(n)
+}
+
+func (p *devParser) args(fields []string, n int) bool {
+	if len(fields) < n+1 && p.err == nil {
+		p.err = fmt.Errorf("%s takes %d arguments", fields[0], n)
+	}
+	return p.err == nil
+}
+
+// Handle one declaration
+func (p *devParser) declare(dev *Device, fields []string) {
+	switch fields[0] {
+	case "device":
+		if p.args(fields, 1) {
+			dev.Name = fields[1]
+		}
+	case "progsize":
+		if p.args(fields, 1) {
+			dev.ProgSize = p.num(fields[1])
+		}
+	case "ram":
+		if p.args(fields, 2) {
+			dev.RAMStart = p.num(fields[1])
+			dev.RAMEnd = p.num(fields[2])
+		}
+	case "sfr":
+		if p.args(fields, 2) {
+			dev.SFRs = append(dev.SFRs, Register{fields[1], p.num(fields[2])})
+		}
+	case "shared":
+		if p.args(fields, 2) {
+			dev.Shared = append(dev.Shared, Range{p.num(fields[1]), p.num(fields[2])})
+		}
+	case "config":
+		if p.args(fields, 2) {
+			dev.Config.Addr = p.num(fields[1])
+			dev.Config.Default = p.num(fields[2])
+		}
+	case "eeprom":
+		if p.args(fields, 2) {
+			dev.EEPROM.Addr = p.num(fields[1])
+			dev.EEPROM.Size = p.num(fields[2])
+		}
+	case "field":
+		if p.args(fields, 2) {
+			f := ConfigField{fields[1], p.num(fields[2]), make(map[string]int)}
+			for _, v := range fields[3:] {
+				name, val, ok := strings.Cut(v, "=")
+				if !ok && p.err == nil {
+					p.err = fmt.Errorf("NAME=value expected, found %s", v)
+				}
+				f.Values[name] = p.num(val)
+			}
+			dev.Config.Fields = append(dev.Config.Fields, f)
+		}
+	default:
+		p.err = fmt.Errorf("unknown declaration %s", fields[0])
+	}
+}
+
+// Parse a device description
+func ReadDevice(r io.Reader) (*Device, error) {
+	var p devParser
+
+	dev := new(Device)
+	sc := bufio.NewScanner(r)
+	for line := 1; sc.Scan(); line += 1 {
+		text, _, _ := strings.Cut(sc.Text(), "#")
+		if fields := strings.Fields(text); len(fields) > 0 {
+			p.declare(dev, fields)
+		}
+		if p.err != nil {
+			return nil, fmt.Errorf("line %d: %v", line, p.err)
+		}
+	}
+	if err := sc.Err(); err != nil {
+		return nil, err
+	}
+
+	// Sanity checks
+	if dev.Name == "" || dev.ProgSize <= 0 || dev.RAMStart <= 0 || dev.RAMEnd < dev.RAMStart {
+		return nil, fmt.Errorf("device, progsize and ram must be given")
+	}
+	return dev, nil
+}
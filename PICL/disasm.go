@@ -0,0 +1,99 @@
+/*
+disasm.go: Disassembly of program memory images
+Notes:
+1. Registers are named after the SFRs of the device. The bank is followed
+   through BCF/BSF STATUS,RP0 and RP1 in address order, from bank 0 at
+   reset. At a branch target, after GOTO, RETURN, RETLW or RETFIE and after
+   a skipped bank change it is unknown, and only the registers common to
+   all banks are named then
+2. Branch targets get labels Lnnn, their address in hex. GOTO and CALL are
+   taken to stay within the 2K page of the instruction
+3. Words in the table ranges are shown as DT, words that are no instruction
+   as DW
+*/
+
+package PICL
+
+import (
+	"fmt"
+	"io"
+)
+
+// STATUS bits selecting the register bank
+const (
+	rp0 = 5
+	rp1 = 6
+)
+
+// Listing of the image in r, with the register names of device d and
+// labels at the branch targets
+// The image need not come from the compiler, eg a HEX file read back
+func (r *Result) Disassemble(w io.Writer, d *Device) {
+	names := make(map[int]string)
+	for _, reg := range d.SFRs {
+		names[reg.Addr] = reg.Name
+	}
+	labels := make(map[int]bool)
+	for i, u := range r.Code {
+		if u/0x1000 == 2 && !r.isData(i) {
+			labels[i&^0x7FF|u%0x800] = true
+		}
+	}
+
+	bank := 0
+	reg := func(f int) string {
+		a := f
+		if bank != unknown {
+			a = bank*0x80 + f
+		} else if d.Banked(f) {
+			return fmt.Sprintf("%#.2x", f)
+		}
+		if n, ok := names[a]; ok {
+			return n
+		} else if n, ok := names[f]; ok && !d.Banked(f) {
+			return n
+		}
+		return fmt.Sprintf("%#.2x", f)
+	}
+	label := func(k int) string {
+		return fmt.Sprintf("L%.3X", k)
+	}
+
+	r.header(w)
+	fmt.Fprintf(w, "Addr  Opcode Label Instruction\n")
+	skip := false
+	for i, u := range r.Code {
+		lbl := ""
+		if labels[i] {
+			lbl = label(i) + ":"
+			bank = unknown
+		}
+		k := i &^ 0x7FF
+		target := func(a int) string { return label(k | a) }
+		if r.isData(i) {
+			fmt.Fprintf(w, "%#.3x %#.4x %-5s DT     %#.2x\n", i, u, lbl, u%0x100)
+			continue
+		}
+		s := decode(u, reg, target)
+		if s == "" {
+			s = fmt.Sprintf("DW     %#.4x", u)
+		}
+		fmt.Fprintf(w, "%#.3x %#.4x %-5s %s\n", i, u, lbl, s)
+
+		// Follow the bank bits
+		op, b, f := u/0x400, u/0x80%8, u%0x80
+		switch {
+		case (op == 4 || op == 5) && f == 3 && (b == rp0 || b == rp1):
+			if skip {
+				bank = unknown
+			} else if bank != unknown {
+				bank = bank&^(1<<(b-rp0)) | (op-4)<<(b-rp0)
+			} else if b == rp0 && d.Banks() == 2 {
+				bank = op - 4
+			}
+		case u/0x800 == 5, u == 8, u == 9, u/0x400 == 0x0D:
+			bank = unknown
+		}
+		skip = op == 6 || op == 7 || u/0x100 == 0x0B || u/0x100 == 0x0F
+	}
+}
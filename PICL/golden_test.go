@@ -0,0 +1,111 @@
+/*
+golden_test.go: Golden output tests
+Each program in test/ starts with a comment holding the expected code image:
+{ Expected output:
+  0 0x080C
+  1 0x008D
+  ...
+}
+Addresses and opcodes are hex, anything after the opcode is ignored. The
+programs are compiled for Wirth's original environment
+*/
+
+package PICL
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// The environment of Wirth's original PICL: a PIC16F84 with TMR0, STATUS
+// and the ports predeclared as T, S, A and B
+var wirth = &Device{
+	Name:     "PIC16F84 (Wirth)",
+	ProgSize: 0x400,
+	RAMStart: 0x0C,
+	RAMEnd:   0x4F,
+	SFRs: []Register{
+		{"T", 0x01}, {"S", 0x03}, {"A", 0x05}, {"B", 0x06},
+	},
+	Shared: []Range{{0x0C, 0x4F}},
+	Config: ConfigWord{Addr: 0x2007, Default: 0x3FFF},
+}
+
+var golden = regexp.MustCompile(`(?m)^\s*([0-9A-Fa-f]+)\s+0[xX]([0-9A-Fa-f]+)`)
+
+// Extract the expected code image from the leading comment
+func expected(src []byte) ([]int, error) {
+	start := bytes.IndexByte(src, '{')
+	end := bytes.IndexByte(src, '}')
+	if start < 0 || end < start || !bytes.Contains(src[start:end], []byte("Expected output:")) {
+		return nil, fmt.Errorf("no { Expected output: ... } comment")
+	}
+	var code []int
+	for _, m := range golden.FindAllSubmatch(src[start:end], -1) {
+		addr, _ := strconv.ParseInt(string(m[1]), 16, 32)
+		op, _ := strconv.ParseInt(string(m[2]), 16, 32)
+		if int(addr) != len(code) {
+			return nil, fmt.Errorf("expected output: address %#x out of sequence", addr)
+		}
+		code = append(code, int(op))
+	}
+	return code, nil
+}
+
+// The differing words of two code images side by side
+func codeDiff(want, got []int) string {
+	var b strings.Builder
+	word := func(code []int, i int) string {
+		if i >= len(code) {
+			return "-"
+		}
+		return fmt.Sprintf("%#.4x %s", code[i], Disasm(code[i]))
+	}
+	fmt.Fprintf(&b, "Addr  %-24s %s\n", "Expected", "Got")
+	for i := 0; i < len(want) || i < len(got); i += 1 {
+		if i >= len(want) || i >= len(got) || want[i] != got[i] {
+			fmt.Fprintf(&b, "%#.3x %-24s %s\n", i, word(want, i), word(got, i))
+		}
+	}
+	return b.String()
+}
+
+func TestGolden(t *testing.T) {
+	files, err := filepath.Glob(filepath.Join("..", "test", "*.pcl"))
+	if err != nil || len(files) == 0 {
+		t.Fatalf("no test programs: %v", err)
+	}
+	for _, filename := range files {
+		t.Run(filepath.Base(filename), func(t *testing.T) {
+			src, err := os.ReadFile(filename)
+			if err != nil {
+				t.Fatal(err)
+			}
+			want, err := expected(src)
+			if err != nil {
+				t.Fatal(err)
+			}
+			res, err := NewCompiler(wirth).Compile(bytes.NewReader(src))
+			if err != nil {
+				for _, d := range res.Diagnostics {
+					t.Log(d)
+				}
+				t.Fatal(err)
+			}
+			if len(want) != len(res.Code) {
+				t.Fatalf("%d words expected, got %d\n%s", len(want), len(res.Code), codeDiff(want, res.Code))
+			}
+			for i := range want {
+				if want[i] != res.Code[i] {
+					t.Fatalf("code differs\n%s", codeDiff(want, res.Code))
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,110 @@
+/*
+inline.go: Assembly code in PICL, ASM ... END
+Notes:
+1. The text between ASM and END is assembled in place by the asm package,
+   a statement per line, see asm.go there. It may name the variables,
+   constants and procedures in scope, procedures by their entry address.
+   Labels are local to the block
+2. Register operands are given by their full address. The block starts in
+   the bank of its first banked register, or in bank 0, and follows the
+   BCF and BSF on RP0 and RP1 in the order of the text. An operand outside
+   the selected bank is an error. The bank is unknown after the block
+3. The code must be contiguous, ORG and __CONFIG are not allowed
+4. Errors are reported at their line in the PICL source
+5. The block ends at END as the first word of a line, see PICS.Text
+*/
+
+package PICL
+
+import (
+	"fmt"
+	"picl-go/PICS"
+	"picl-go/asm"
+)
+
+// ASM statement, at the symbol ASM
+func (c *Compiler) AsmStat() {
+	pos := c.sc.Pos
+	text, ok := c.sc.Text()
+	if !ok {
+		c.Mark(60)
+	}
+
+	a := asm.New()
+	for obj := c.idList; obj != nil; obj = obj.next {
+		if _, ok := a.Symbols[string(obj.name)]; !ok && obj.form >= Variable && obj.form <= Procedure {
+			a.Symbols[string(obj.name)] = obj.a
+		}
+	}
+	a.ConfigAddr = c.dev.Config.Addr
+	// Selecting the bank may put down code, the text is assembled after it
+	segs, _ := a.Assemble(text, c.pc)
+	c.setBank(c.asmBank(segs))
+	segs, errs := a.Assemble(text, c.pc)
+	for _, e := range errs {
+		c.asmError(pos.Line+e.Line-1, 61, "Assembler: "+e.Msg)
+	}
+	if len(segs) > 1 || (len(segs) == 1 && segs[0].Addr != c.pc) {
+		c.Mark(62)
+	} else if len(segs) == 1 {
+		s := segs[0]
+		for i, w := range s.Words {
+			line := pos.Line + s.Lines[i] - 1
+			if r := s.Regs[i]; r >= 0 && c.dev.Banked(r) && r/0x80 != c.rp {
+				c.asmError(line, 64, fmt.Sprintf(parseErr[64], c.asmName(r), r/0x80, c.rp))
+			}
+			c.line(PICS.Pos{Line: line, Col: 1})
+			c.reg, c.regPc = s.Regs[i], c.pc
+			c.put(w)
+			c.asmSelect(w, s.Regs[i])
+		}
+	}
+	c.rp = unknown
+	c.sc.Get(&c.sym)
+}
+
+// Bank the code of an ASM block starts in: that of its first banked
+// register, unless it selects a bank before
+func (c *Compiler) asmBank(segs []asm.Segment) int {
+	if len(segs) == 0 {
+		return 0
+	}
+	for i, r := range segs[0].Regs {
+		if r%0x80 == 3 && segs[0].Words[i]&0x3800 == 0x1000 {
+			return 0
+		} else if r >= 0 && c.dev.Banked(r) {
+			return r / 0x80 % c.banks
+		}
+	}
+	return 0
+}
+
+// Follow BCF and BSF on RP0 and RP1 of STATUS, instruction w on register r
+func (c *Compiler) asmSelect(w, r int) {
+	if r < 0 || r%0x80 != 3 || w&0x3800 != 0x1000 {
+		return
+	}
+	bit := 1 << (w >> 7 & 7) >> 5 // RP0 1, RP1 2
+	if bit != 1 && bit != 2 || bit == 2 && c.banks == 2 {
+		return
+	}
+	if w&0x400 != 0 {
+		c.rp |= bit
+	} else {
+		c.rp &^= bit
+	}
+}
+
+// Name of register r for a message
+func (c *Compiler) asmName(r int) string {
+	if n := c.regName(r); n != "" {
+		return n
+	}
+	return fmt.Sprintf("Register %#.3x", r)
+}
+
+// Error in line of an ASM block
+func (c *Compiler) asmError(line, n int, msg string) {
+	c.diags = append(c.diags, Diagnostic{PICS.Pos{Line: line, Col: 1}, Error, n, msg})
+	c.errs += 1
+}
@@ -0,0 +1,100 @@
+/*
+interrupt.go: Interrupt procedures
+Notes:
+1. PROCEDURE* name; declares the interrupt procedure, as in Oberon-07. As
+   the first procedure it is placed at the interrupt vector 0x004, words 1
+   to 3 are NOPs then. After other procedures, which it may call, the
+   module is compiled again with words 1 to 4 kept free, and a GOTO to the
+   procedure at the vector. PCLATH bits 3 and 4 are 0 at an interrupt, as
+   the code is in the first page
+2. On entry W, STATUS, PCLATH and FSR are saved and bank 0 is selected,
+   on exit they are restored and RETFIE ends the procedure. W is saved in
+   a register common to all banks, taken from the top of RAM, the others
+   are allocated like variables
+3. Procedures called from both the interrupt procedure and the module are
+   not reentrant. The runtime routines may be used by only one of them,
+   see runtime.go
+*/
+
+package PICL
+
+import "picl-go/PICS"
+
+// Address of the interrupt vector
+const vector = 0x004
+
+// Registers saved by the interrupt procedure
+const (
+	saveW = iota
+	saveStatus
+	savePclath
+	saveFsr
+	nSaved
+)
+
+// Names of the registers they are saved in
+var savedNames = [nSaved]string{"_saveW", "_saveSTATUS", "_savePCLATH", "_saveFSR"}
+
+// Prepare for the interrupt procedure, at its declaration
+// Returns its address
+func (c *Compiler) interrupt() int {
+	if c.isr != nil {
+		c.Mark(50)
+	}
+	if c.pc > vector {
+		if c.vectorJump {
+			c.code[vector] = c.pc + 0x2800
+		}
+		c.vectorJump = true // compile again, see Compile
+	}
+	for c.pc < vector {
+		c.emit(0, 0)
+	}
+	return c.pc
+}
+
+// Register common to all banks for saving W, at the top of RAM
+func (c *Compiler) sharedReg() int {
+	for a := c.top; a >= c.dc; a -= 1 {
+		if !c.dev.Banked(a) {
+			c.top = a - 1
+			return a
+		}
+	}
+	c.Mark(54)
+	return c.top
+}
+
+// Put down the context save at the start of the interrupt procedure
+func (c *Compiler) save() {
+	c.saved[saveW] = c.internalReg(c.sharedReg(), savedNames[saveW], PICS.Int_t)
+	for i := saveStatus; i < nSaved; i += 1 {
+		c.saved[i] = c.internalReg(c.alloc([]byte("(interrupt)")), savedNames[i], PICS.Int_t)
+	}
+	c.rp = unknown
+	c.emit(0, c.file(c.saved[saveW])+0x80)
+	c.emit(0x0E, 3)
+	c.emit(1, 3+0x80)
+	c.rp = 0
+	c.emit(0, c.file(c.saved[saveStatus])+0x80)
+	c.emit(0x08, pclath)
+	c.emit(0, c.file(c.saved[savePclath])+0x80)
+	c.emit(1, pclath+0x80)
+	c.emit(0x08, fsr)
+	c.emit(0, c.file(c.saved[saveFsr])+0x80)
+}
+
+// Put down the context restore and return at the end of the interrupt
+// procedure
+func (c *Compiler) restore() {
+	c.emit(0x08, c.file(c.saved[saveFsr]))
+	c.emit(0, fsr+0x80)
+	c.emit(0x08, c.file(c.saved[savePclath]))
+	c.emit(0, pclath+0x80)
+	c.emit(0x0E, c.file(c.saved[saveStatus]))
+	c.emit(0, 3+0x80)
+	c.rp = unknown
+	c.emit(0x0E, c.file(c.saved[saveW])+0x80)
+	c.emit(0x0E, c.file(c.saved[saveW]))
+	c.emit(0, 9)
+}
@@ -0,0 +1,248 @@
+/*
+mpasm.go: Assembly source for MPASM and gpasm
+Notes:
+1. The output assembles to the same image as the compiler's: registers are
+   declared with EQU at their full address, MPASM and gpasm take the low 7
+   bits (message 302), likewise GOTO and CALL the low 11 bits of a label
+2. PICL identifiers have no underscore, so the names made up here cannot
+   clash with them: locals are proc_name, labels of the module body, the
+   runtime routines and branch targets start with _, and so do the names
+   of the temporaries and other registers of the compiler's own. A PICL
+   name that is a reserved word of the assembler gets a trailing _
+3. No include file is needed, the registers of the device are declared
+4. Each source line comes as a comment above its code, see Decode
+*/
+
+package PICL
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// Words the assembler reserves, besides the mnemonics in the tables
+var reserved = map[string]bool{}
+
+func init() {
+	words := []string{"W", "F", "NOP", "RETURN", "RETFIE", "SLEEP", "CLRWDT",
+		"CLRW", "OPTION", "TRIS", "HIGH", "LOW", "UPPER", "END", "ORG", "EQU",
+		"SET", "DW", "DE", "DT", "DB", "DATA", "RES", "FILL", "IF", "ELSE",
+		"ENDIF", "WHILE", "ENDW", "MACRO", "ENDM", "LOCAL", "EXITM", "CONSTANT",
+		"VARIABLE", "CBLOCK", "ENDC", "BANKSEL", "PAGESEL", "LIST", "NOLIST",
+		"RADIX", "PROCESSOR", "INCLUDE", "ERROR", "MESSG", "TITLE", "SPACE",
+		"PAGE", "CODE", "UDATA", "GLOBAL", "EXTERN", "__CONFIG"}
+	for _, t := range [][]string{words, table0[:], table1[:], table2[:], table3[:]} {
+		for _, m := range t {
+			reserved[strings.TrimSpace(m)] = true
+		}
+	}
+}
+
+// Literal instructions as the assembler encodes them, bits 8-11 of the
+// opcode. The other encodings of MOVLW, RETLW, SUBLW and ADDLW become DW
+var canonical = map[int]bool{0x0: true, 0x4: true, 0x8: true, 0x9: true, 0xA: true, 0xC: true, 0xE: true}
+
+// Assembler name for a PICL name
+func asmName(name string) string {
+	if reserved[strings.ToUpper(name)] {
+		return name + "_"
+	}
+	return name
+}
+
+// Assembly source of the image in r for device d
+func (r *Result) Assembly(w io.Writer, d *Device) {
+	// Registers and variables of all scopes
+	equ := make(map[string]int)
+	var names []string
+	declare := func(name string, a int) {
+		if _, ok := equ[name]; !ok {
+			names = append(names, name)
+		}
+		equ[name] = a
+	}
+	for _, reg := range d.SFRs {
+		declare(asmName(reg.Name), reg.Addr)
+	}
+	nSFRs := len(names)
+	for i := len(r.Symbols) - 1; i >= 0; i -= 1 {
+		if s := r.Symbols[i]; s.Form == Variable {
+			declare(asmName(s.Name), s.Addr)
+		}
+	}
+	for _, b := range r.Blocks {
+		for _, s := range append(append([]Symbol(nil), b.Params...), b.Locals...) {
+			declare(b.Name+"_"+s.Name, s.Addr)
+		}
+	}
+	nVars := len(names)
+	for _, s := range r.Internal {
+		declare(s.Name, s.Addr)
+	}
+
+	// Labels of the blocks and of all branch targets
+	labels := make(map[int]string)
+	for i, u := range r.Code {
+		if u/0x1000 == 2 && !r.isData(i) {
+			k := i&^0x7FF | u%0x800
+			labels[k] = fmt.Sprintf("_L%.3X", k)
+		}
+	}
+	for _, b := range r.Blocks {
+		switch b.Kind {
+		case ModuleBlock:
+			labels[b.Addr] = "_main"
+		case RuntimeBlock:
+			labels[b.Addr] = "_" + b.Name
+		default:
+			labels[b.Addr] = asmName(b.Name)
+		}
+	}
+
+	// Block holding address a
+	block := func(a int) *Block {
+		for i := range r.Blocks {
+			if b := &r.Blocks[i]; a >= b.Addr && a < b.Addr+b.Size {
+				return b
+			}
+		}
+		return nil
+	}
+
+	// Operand for register f of the instruction at address at
+	var at int
+	reg := func(f int) string {
+		n, ok := r.Names[at]
+		if !ok {
+			return fmt.Sprintf("0x%.2X", f)
+		}
+		name, off := n, 0
+		if k := strings.IndexByte(n, '+'); k >= 0 {
+			name = n[:k]
+			fmt.Sscan(n[k+1:], &off)
+		}
+		sym := asmName(name)
+		if k := strings.IndexByte(name, '.'); k >= 0 {
+			// Parameter of the procedure called
+			sym = name[:k] + "_" + name[k+1:]
+		} else if b := block(at); b != nil {
+			if _, ok := equ[b.Name+"_"+name]; ok {
+				sym = b.Name + "_" + name
+			}
+		}
+		if a, ok := equ[sym]; !ok || (a+off)%0x80 != f {
+			return fmt.Sprintf("0x%.2X", f)
+		} else if off > 0 {
+			return fmt.Sprintf("%s+0x%.2X", sym, off)
+		}
+		return sym
+	}
+
+	name := strings.TrimPrefix(strings.Fields(d.Name + " ")[0], "PIC")
+	fmt.Fprintf(w, "; %s for %s\n\n", r.Module, d.Name)
+	fmt.Fprintf(w, "\tPROCESSOR %s\n", name)
+	if r.Config >= 0 {
+		fmt.Fprintf(w, "\t__CONFIG 0x%.4X\n", r.Config)
+	}
+
+	fmt.Fprintf(w, "\n; Registers\n")
+	for i, n := range names {
+		if i == nSFRs {
+			fmt.Fprintf(w, "\n; Variables\n")
+		}
+		if i == nVars {
+			fmt.Fprintf(w, "\n; Registers of the compiler\n")
+		}
+		fmt.Fprintf(w, "%-16s EQU 0x%.3X\n", n, equ[n])
+	}
+
+	// Code, each source line above its code as a comment
+	src := bytes.Split(bytes.TrimRight(r.Source, "\n"), []byte("\n"))
+	if len(r.Source) == 0 {
+		src = nil
+	}
+	shown := 0
+	show := func(n int) {
+		for ; shown < n && shown < len(src); shown += 1 {
+			fmt.Fprintf(w, "; %4d  %s\n", shown+1, bytes.TrimRight(src[shown], "\r"))
+		}
+	}
+
+	fmt.Fprintf(w, "\n\tORG 0x000\n")
+	ln := 0
+	for i, u := range r.Code {
+		for ; ln < len(r.Lines) && r.Lines[ln].Addr <= i; ln += 1 {
+			if n := r.Lines[ln].Pos.Line; n > 0 {
+				show(n)
+			}
+		}
+		if l, ok := labels[i]; ok {
+			fmt.Fprintf(w, "%s:\n", l)
+		}
+		at = i
+		fmt.Fprintf(w, "\t%s\n", asmInstr(u, reg, func(k int) string {
+			k |= i &^ 0x7FF
+			if l, ok := labels[k]; ok && k <= len(r.Code) {
+				return l
+			}
+			return fmt.Sprintf("0x%.3X", k)
+		}))
+	}
+	// A jump to the end of the code, eg from the last loop of the module
+	if l, ok := labels[len(r.Code)]; ok {
+		fmt.Fprintf(w, "%s:\n", l)
+	}
+	show(len(src))
+
+	if len(r.EEPROM) > 0 {
+		fmt.Fprintf(w, "\n; Data EEPROM\n\tORG 0x%.4X\n", d.EEPROM.Addr)
+		var b []string
+		for i, v := range r.EEPROM {
+			b = append(b, fmt.Sprintf("0x%.2X", v))
+			if len(b) == 8 || i == len(r.EEPROM)-1 {
+				fmt.Fprintf(w, "\tDE %s\n", strings.Join(b, ", "))
+				b = nil
+			}
+		}
+	}
+	fmt.Fprintf(w, "\n\tEND\n")
+}
+
+// Instruction u in assembler syntax, reg names register f and label names
+// branch target k. Words that are no instruction, or that the assembler
+// would encode otherwise, become DW
+func asmInstr(u int, reg func(f int) string, label func(k int) string) string {
+	op, f, d := u/0x100, u%0x80, "W"
+	if u/0x80%2 == 1 {
+		d = "F"
+	}
+	switch {
+	case u == 8:
+		return "RETURN"
+	case u == 9:
+		return "RETFIE"
+	case u == 0x63:
+		return "SLEEP"
+	case u == 0x64:
+		return "CLRWDT"
+	case u == 0:
+		return "NOP"
+	case op == 0 && d == "F":
+		return "MOVWF  " + reg(f)
+	case u == 0x0103:
+		return "CLRW"
+	case op == 1 && d == "F":
+		return "CLRF   " + reg(f)
+	case op > 1 && op < 0x10:
+		return fmt.Sprintf("%s %s,%s", table0[op], reg(f), d)
+	case u/0x1000 == 1:
+		return fmt.Sprintf("%s %s,%d", table1[u/0x400%4], reg(f), u/0x80%8)
+	case u/0x1000 == 2:
+		return fmt.Sprintf("%s %s", table2[u/0x800%2], label(u%0x800))
+	case u/0x1000 == 3 && canonical[op%0x10]:
+		return fmt.Sprintf("%s 0x%.2X", table3[op%0x10], u%0x100)
+	}
+	return fmt.Sprintf("DW     0x%.4X", u)
+}
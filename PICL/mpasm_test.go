@@ -0,0 +1,83 @@
+package PICL
+
+import (
+	"picl-go/asm"
+	"regexp"
+	"strings"
+	"testing"
+)
+
+const mpasmSrc = `MODULE S;
+  INT n, x, y;
+  WORD w;
+  PROCEDURE* Tick;
+  BEGIN INC n
+  END Tick;
+  PROCEDURE Sub(INT a, b): INT;
+  BEGIN RETURN a - b
+  END Sub;
+  PROCEDURE Add(WORD v);
+  BEGIN w := w + v
+  END Add;
+BEGIN
+  x := 7; y := x * 3 + x / 2;
+  y := Sub(Sub(20, x), Sub(y, x + 1));
+  Add(300); w := w + w + 1
+END S.
+`
+
+// A register operand given as a number
+var rawReg = regexp.MustCompile(`(?m)^\t(MOVWF|CLRF|[A-Z]+WF|[A-Z]+F|[A-Z]+FSZ|B[CST][FS]+[CS]?)\s+0x`)
+
+// The assembly source names every register and assembles to the same code
+func TestAssembly(t *testing.T) {
+	res := compile(t, "16F688", mpasmSrc)
+	if res.Errors != 0 {
+		t.Fatalf("errors %v", errCodes(res))
+	}
+	dev, _ := LoadDevice("16F688")
+	var b strings.Builder
+	res.Assembly(&b, dev)
+	src := b.String()
+
+	if m := rawReg.FindAllString(src, -1); len(m) > 0 {
+		t.Errorf("registers without a name: %q", m)
+	}
+	for _, name := range []string{"_rtA", "_saveW", "Sub_a", "Add_v"} {
+		if !strings.Contains(src, "\n"+name+" ") {
+			t.Errorf("%s not declared", name)
+		}
+	}
+
+	a := asm.New()
+	a.ConfigAddr = dev.Config.Addr
+	segs, errs := a.Assemble([]byte(src), 0)
+	if len(errs) > 0 {
+		t.Fatalf("assembler errors %v", errs)
+	}
+	if len(segs) != 1 || segs[0].Addr != 0 || len(segs[0].Words) != len(res.Code) {
+		t.Fatalf("assembled %d segments, want the code at 0", len(segs))
+	}
+	for i, u := range segs[0].Words {
+		if u != res.Code[i] {
+			t.Errorf("word %#.3x assembled to %#.4x, want %#.4x", i, u, res.Code[i])
+		}
+	}
+}
+
+// MPASM and gpasm read numbers as hex by default, offsets into arrays are
+// written in hex
+func TestAssemblyOffsets(t *testing.T) {
+	res := compile(t, "16F688", "MODULE R;\n  ARRAY 16 OF INT a;\nBEGIN\n  a[12] := 1; a[3] := 2\nEND R.\n")
+	if res.Errors != 0 {
+		t.Fatalf("errors %v", errCodes(res))
+	}
+	dev, _ := LoadDevice("16F688")
+	var b strings.Builder
+	res.Assembly(&b, dev)
+	for _, s := range []string{"\tMOVWF  a+0x0C\n", "\tMOVWF  a+0x03\n"} {
+		if !strings.Contains(b.String(), s) {
+			t.Errorf("%q missing in\n%s", s, b.String())
+		}
+	}
+}
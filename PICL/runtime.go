@@ -0,0 +1,194 @@
+/*
+runtime.go: Routines for the INT operators without a PIC16 instruction
+Notes:
+1. x * y, x / y and x MOD y call a routine, put down after the module body
+   and only if used, like the tables. The body then ends with a jump over
+   the routines
+2. Operands are passed in two registers, x in A and y in B. The result is
+   returned in W, MOD fetches the remainder from M after the call
+3. Unsigned 8-bit arithmetic, the product is taken modulo 256. x / 0 is 255
+   and x MOD 0 is x
+4. Costs, in cycles including CALL and RETURN, not counting the loading of
+   the operands:
+     mul   13 words, 5 + 11 per significant bit of y (at least one),
+           16 to 93
+     div   20 words, 112 to 128
+   MOD takes one more instruction than /
+5. The registers are allocated with the variables when first needed, they
+   are shared by all procedures. An interrupt could corrupt them in the
+   middle of a routine, so the interrupt procedure and the rest of the
+   module cannot both use the routines
+*/
+
+package PICL
+
+import "picl-go/PICS"
+
+// Runtime routines
+const (
+	rtMul = iota
+	rtDiv
+	nRoutines
+)
+
+// Runtime registers, see rtReg
+const (
+	regA = iota // x, shifted out
+	regB        // y
+	regR        // product or quotient
+	regM        // remainder
+	regN        // bit counter
+)
+
+// Names of the runtime registers, for the listing and the assembly source
+var rtNames = [...]string{"_rtA", "_rtB", "_rtR", "_rtM", "_rtN"}
+
+var routines = [nRoutines]struct {
+	name string
+	regs int
+	gen  func(c *Compiler)
+}{
+	{"mul", regR + 1, (*Compiler).mul},
+	{"div", regN + 1, (*Compiler).div},
+}
+
+// Address of runtime register i, allocating it if need be
+func (c *Compiler) rtReg(i int) int {
+	for len(c.rtRegs) <= i {
+		a := c.alloc([]byte("(runtime)"))
+		c.rtRegs = append(c.rtRegs, c.internalReg(a, rtNames[len(c.rtRegs)], PICS.Int_t))
+	}
+	return c.rtRegs[i]
+}
+
+// Put down x op y for *, / and MOD on integers
+func (c *Compiler) runtime(op int, x item, y item) item {
+	var r int
+
+	if op == PICS.Ast {
+		r = rtMul
+	} else {
+		r = rtDiv
+	}
+	if c.isrRuntime {
+		c.Mark(63)
+	}
+	c.rtReg(routines[r].regs - 1)
+	a := c.rtReg(regA)
+	b := c.rtReg(regB)
+	if y.mode == inW {
+		c.emit(0, c.file(b)+0x80)
+		c.load(x)
+		c.emit(0, c.file(a)+0x80)
+	} else {
+		c.load(x)
+		c.emit(0, c.file(a)+0x80)
+		c.load(y)
+		c.emit(0, c.file(b)+0x80)
+	}
+	// CALL, fixed up by link
+	c.setBank(0)
+	c.rtCalls[r] = append(c.rtCalls[r], c.pc)
+	c.emit(0x20, 0)
+	c.rp = 0
+	if op == PICS.Mod {
+		c.emit(0x08, c.file(c.rtReg(regM)))
+	}
+	return item{inW, PICS.Int_t, 0}
+}
+
+// Put down the routines and tables called by the module
+func (c *Compiler) link() {
+	var L, entry, k, k1 int
+
+	used := false
+	for r := range routines {
+		used = used || len(c.rtCalls[r]) > 0
+	}
+	for _, t := range c.tables {
+		used = used || t.a != 0
+	}
+	if !used {
+		return
+	}
+	c.line(PICS.Pos{})
+	L = c.jump(0)
+	for r := range routines {
+		if len(c.rtCalls[r]) > 0 {
+			c.rp = 0
+			entry = c.pc
+			routines[r].gen(c)
+			c.blocks = append(c.blocks, Block{Name: routines[r].name, Kind: RuntimeBlock, Addr: entry, Size: c.pc - entry})
+			for _, a := range c.rtCalls[r] {
+				c.code[a] = 0x2000 + entry
+			}
+		}
+	}
+	for _, t := range c.tables {
+		if t.a != 0 {
+			entry = c.pc
+			c.table(t.data)
+			for k = t.a; k != 0; k = k1 {
+				k1 = c.code[k] % 0x800
+				c.code[k] = 0x2000 + entry
+			}
+			t.a = entry
+			c.blocks = append(c.blocks, Block{Name: string(t.name), Kind: TableBlock, Addr: entry, Size: c.pc - entry})
+		}
+	}
+	c.rp = unreachable
+	c.fixup(L, c.pc)
+}
+
+// W := A * B, shift and add
+func (c *Compiler) mul() {
+	a, b, p := c.rtReg(regA), c.rtReg(regB), c.rtReg(regR)
+
+	c.emit(1, c.file(p)+0x80)
+	L0 := c.pc
+	c.emit1(0, 0, 3)
+	c.emit(0x0C, c.file(b)+0x80)
+	c.emit(0x08, c.file(a))
+	c.emit1(2, 0, 3)
+	c.emit(0x07, c.file(p)+0x80)
+	c.emit1(0, 0, 3)
+	c.emit(0x0D, c.file(a)+0x80)
+	c.emit(0x08, c.file(b)+0x80)
+	c.emit1(3, 2, 3)
+	c.emit(0x28, L0)
+	c.emit(0x08, c.file(p))
+	c.emit(0, 8)
+}
+
+// W := A / B, M := A MOD B, shift and subtract
+// The partial remainder may grow to 9 bits, the carry out of M holds the
+// ninth
+func (c *Compiler) div() {
+	var L0, L1, L2 int
+
+	a, b, q, m, n := c.rtReg(regA), c.rtReg(regB), c.rtReg(regR), c.rtReg(regM), c.rtReg(regN)
+	c.emit(1, c.file(q)+0x80)
+	c.emit(1, c.file(m)+0x80)
+	c.emit(0x30, 8)
+	c.emit(0, c.file(n)+0x80)
+	L0 = c.pc
+	c.emit(0x0D, c.file(a)+0x80)
+	c.emit(0x0D, c.file(m)+0x80)
+	c.emit1(2, 0, 3)
+	L1 = c.jump(0)
+	c.emit(0x08, c.file(b))
+	c.emit(0x02, c.file(m))
+	c.emit1(3, 0, 3)
+	L2 = c.jump(0)
+	c.rp = unreachable
+	c.fixup(L1, c.pc)
+	c.emit(0x08, c.file(b))
+	c.emit(0x02, c.file(m)+0x80)
+	c.emit1(1, 0, 3)
+	c.fixup(L2, c.pc)
+	c.emit(0x0D, c.file(q)+0x80)
+	c.emit(0x0B, c.file(n)+0x80)
+	c.emit(0x28, L0)
+	c.emit(0x08, c.file(q))
+	c.emit(0, 8)
+}
@@ -0,0 +1,210 @@
+/*
+symbols.go: Map file and JSON symbol file
+Notes:
+1. The scope of a procedure is closed at its END, its parameters and local
+   variables are kept in a Block with the code of the procedure
+2. Program memory is divided into blocks: the procedures, the module body,
+   and the runtime routines and tables put down after it, in order of
+   address. Words 1 to 3 or 4 before the interrupt vector are in none
+3. The map file is for reading, the JSON file for scripts. Both list the
+   blocks, the variables of all scopes by address and the constants
+4. The registers of the compiler's own, temporaries, runtime and context
+   save registers, are listed with the variables in the scope (compiler),
+   so that the variables add up to the RAM used
+*/
+
+package PICL
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+)
+
+// Kinds of blocks
+const (
+	ProcBlock      = "procedure"
+	InterruptBlock = "interrupt"
+	ModuleBlock    = "module"
+	RuntimeBlock   = "runtime"
+	TableBlock     = "table"
+)
+
+// Block is a piece of program memory and the variables declared with it
+type Block struct {
+	Name   string
+	Kind   string
+	Addr   int      // entry
+	Size   int      // words of code
+	Params []Symbol // in order of declaration
+	Locals []Symbol // in order of declaration, without the parameters
+}
+
+// Symbol table entry of obj
+func symbol(obj Object) Symbol {
+	return Symbol{string(obj.name), obj.form, obj.typ, obj.ptyp, obj.a, obj.size}
+}
+
+// Keep the scope of a procedure, its entries from the top of idList down
+// to but excluding last
+func (c *Compiler) keepScope(name []byte, kind string, entry int, params []Object, last Object) {
+	b := Block{Name: string(name), Kind: kind, Addr: entry, Size: c.pc - entry}
+	for _, p := range params {
+		b.Params = append(b.Params, symbol(p))
+	}
+	for obj := c.idList; obj != last && obj != nil; obj = obj.next {
+		param := false
+		for _, p := range params {
+			param = param || p == obj
+		}
+		if !param {
+			b.Locals = append([]Symbol{symbol(obj)}, b.Locals...)
+		}
+	}
+	c.blocks = append(c.blocks, b)
+}
+
+// Type name of a symbol, eg int or int[16]
+func (s Symbol) typeName() string {
+	if s.Len > 0 {
+		return fmt.Sprintf("%s[%d]", types[s.Typ], s.Len)
+	}
+	return types[s.Typ]
+}
+
+// Scope of the registers of the compiler's own
+const compilerScope = "(compiler)"
+
+// Variable with the name of its scope, for the map
+type scoped struct {
+	Symbol
+	scope string
+	param bool
+}
+
+// Variables of all scopes in order of address
+func (r *Result) variables() []scoped {
+	var vars []scoped
+
+	for _, s := range r.Symbols {
+		if s.Form == Variable {
+			vars = append(vars, scoped{s, r.Module, false})
+		}
+	}
+	for _, b := range r.Blocks {
+		for _, s := range b.Params {
+			vars = append(vars, scoped{s, b.Name, true})
+		}
+		for _, s := range b.Locals {
+			vars = append(vars, scoped{s, b.Name, false})
+		}
+	}
+	for _, s := range r.Internal {
+		vars = append(vars, scoped{s, compilerScope, false})
+	}
+	sort.SliceStable(vars, func(i, j int) bool { return vars[i].Addr < vars[j].Addr })
+	return vars
+}
+
+// Generate the map file
+func (r *Result) MapFile(w io.Writer) {
+	fmt.Fprintf(w, "Module %s\n", r.Module)
+	fmt.Fprintf(w, "%s\n", r.Usage)
+
+	fmt.Fprintf(w, "\nCode:\nAddr  Size Kind       Name\n")
+	for _, b := range r.Blocks {
+		fmt.Fprintf(w, "%#.3x %5d %-10s %s\n", b.Addr, b.Size, b.Kind, b.Name)
+	}
+
+	fmt.Fprintf(w, "\nVariables:\nAddr Type       Name             Scope\n")
+	for _, v := range r.variables() {
+		scope := v.scope
+		if v.param {
+			scope += " (parameter)"
+		}
+		fmt.Fprintf(w, "%#.2x %-10s %-16s %s\n", v.Addr, v.typeName(), v.Name, scope)
+	}
+
+	fmt.Fprintf(w, "\nConstants:\nValue  Type Name\n")
+	for i := len(r.Symbols) - 1; i >= 0; i -= 1 {
+		if s := r.Symbols[i]; s.Form == Constant {
+			fmt.Fprintf(w, "%#.4x %-4s %s\n", s.Addr, types[s.Typ], s.Name)
+		}
+	}
+}
+
+// Entries of the JSON symbol file
+type jsonVar struct {
+	Name  string `json:"name"`
+	Type  string `json:"type"`
+	Addr  int    `json:"addr"`
+	Len   int    `json:"len,omitempty"`
+	Scope string `json:"scope"`
+	Param bool   `json:"param,omitempty"`
+}
+
+type jsonBlock struct {
+	Name   string    `json:"name"`
+	Kind   string    `json:"kind"`
+	Addr   int       `json:"addr"`
+	Size   int       `json:"size"`
+	Result string    `json:"result,omitempty"`
+	Params []jsonVar `json:"params,omitempty"`
+	Locals []jsonVar `json:"locals,omitempty"`
+}
+
+type jsonConst struct {
+	Name  string `json:"name"`
+	Type  string `json:"type"`
+	Value int    `json:"value"`
+}
+
+type jsonFile struct {
+	Module    string      `json:"module"`
+	Device    string      `json:"device"`
+	Blocks    []jsonBlock `json:"blocks"`
+	Variables []jsonVar   `json:"variables"`
+	Constants []jsonConst `json:"constants"`
+}
+
+func jsonVars(syms []Symbol, scope string, param bool) []jsonVar {
+	var vars []jsonVar
+	for _, s := range syms {
+		vars = append(vars, jsonVar{s.Name, types[s.Typ], s.Addr, s.Len, scope, param})
+	}
+	return vars
+}
+
+// Generate the JSON symbol file, for device d
+func (r *Result) WriteJSON(w io.Writer, d *Device) error {
+	f := jsonFile{Module: r.Module, Device: d.Name}
+	results := make(map[string]string)
+	for _, s := range r.Symbols {
+		if s.Form == Procedure && s.Typ != 0 {
+			results[s.Name] = types[s.Typ]
+		}
+	}
+	f.Blocks = []jsonBlock{}
+	for _, b := range r.Blocks {
+		res := ""
+		if b.Kind == ProcBlock {
+			res = results[b.Name]
+		}
+		f.Blocks = append(f.Blocks, jsonBlock{b.Name, b.Kind, b.Addr, b.Size, res,
+			jsonVars(b.Params, b.Name, true), jsonVars(b.Locals, b.Name, false)})
+	}
+	f.Variables = []jsonVar{}
+	for _, v := range r.variables() {
+		f.Variables = append(f.Variables, jsonVar{v.Name, types[v.Typ], v.Addr, v.Len, v.scope, v.param})
+	}
+	f.Constants = []jsonConst{}
+	for i := len(r.Symbols) - 1; i >= 0; i -= 1 {
+		if s := r.Symbols[i]; s.Form == Constant {
+			f.Constants = append(f.Constants, jsonConst{s.Name, types[s.Typ], s.Addr})
+		}
+	}
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(f)
+}
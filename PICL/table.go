@@ -0,0 +1,200 @@
+/*
+table.go: Constant tables in program memory
+Notes:
+1. TABLE name OF INT = (63, 6, 91) puts down a routine that returns entry
+   W of the table:
+     ADDLW   low byte of the address of entry 0
+     BCF/BSF PCLATH bits 0-2, and 3-4 if the device has several pages, to
+             the high byte of the address
+     BTFSC   STATUS,C      only if the entries cross a 256 word boundary
+     INCF    PCLATH,F
+     MOVWF   PCL
+     RETLW   entry 0
+     ...
+   PCLATH is left pointing at the table
+2. The routines of the tables read with a computed index are put down
+   after the module body, like the runtime routines. Until then the calls
+   of a table form a fixup chain starting at its address. The routine
+   does not depend on the bank bits, so calls do not select a bank
+3. With IndexChecks, the routine starts with ADDLW 256-n, BTFSC C,
+   GOTO $-1, ADDLW n, which stops the program at an index out of range
+   and leaves W as it was otherwise
+4. name[i] with a constant i is the entry itself, read when compiling
+5. Tables are declared at module scope, among the variables
+*/
+
+package PICL
+
+import "picl-go/PICS"
+
+// Special function registers used by tables
+const (
+	pcl    = 0x02
+	pclath = 0x0A
+)
+
+// Table declaration, after TABLE
+func (c *Compiler) TableDecl() {
+	var typ int
+	var name = make([]byte, 0, 16)
+	var data []int
+
+	if c.sym == PICS.Ident {
+		name = append(name, c.sc.Id...)
+		c.sc.Get(&c.sym)
+	} else {
+		c.Mark(10)
+	}
+	if c.sym == PICS.Of {
+		c.sc.Get(&c.sym)
+	} else {
+		c.Mark(45)
+	}
+	if typeSym(c.sym) {
+		typ = c.sym - PICS.Int + 1
+		if typ == PICS.Word_t {
+			c.Mark(46)
+		}
+		c.sc.Get(&c.sym)
+	} else {
+		c.Mark(10)
+	}
+	if c.sym == PICS.Eql {
+		c.sc.Get(&c.sym)
+	} else {
+		c.Mark(49)
+	}
+	if c.sym == PICS.Lparen {
+		data = c.byteList()
+	}
+	if len(data) == 0 {
+		c.Mark(49)
+		data = []int{0}
+	} else if len(data) > 0x100 {
+		c.Mark(48)
+	}
+	if c.sym == PICS.Semicolon {
+		c.sc.Get(&c.sym)
+	} else {
+		c.Mark(20)
+	}
+
+	c.enter(string(name), Table, typ, 0)
+	c.idList.size = len(data)
+	c.idList.data = data
+	c.tables = append(c.tables, c.idList)
+}
+
+// List of bytes, eg (1, 2, 3), for tables and the EEPROM
+func (c *Compiler) byteList() []int {
+	var data []int
+
+	c.sc.Get(&c.sym)
+	for c.sym == PICS.Number || c.sym == PICS.Ident {
+		data = append(data, c.byteValue())
+		if c.sym != PICS.Comma {
+			break
+		}
+		c.sc.Get(&c.sym)
+	}
+	if c.sym == PICS.Rparen {
+		c.sc.Get(&c.sym)
+	} else {
+		c.Mark(8)
+	}
+	return data
+}
+
+// Value of a byte in a list, a number or a constant
+func (c *Compiler) byteValue() int {
+	var v int
+
+	if c.sym == PICS.Number {
+		v = c.sc.Val
+	} else {
+		obj := c.this(c.sc.Id)
+		if obj.form != Constant && obj != c.undef {
+			c.Mark(7)
+		}
+		v = obj.a
+	}
+	if v > 0xFF {
+		c.Mark(32)
+	}
+	c.sc.Get(&c.sym)
+	return v & 0xFF
+}
+
+// Put down the routine returning entry W of data, at the end of the module
+func (c *Compiler) table(data []int) {
+	var hdr, first int
+	var cross bool
+
+	n := len(data)
+	bits := 3
+	if c.dev.ProgSize > 0x800 {
+		bits = 5
+	}
+	hdr = bits + 2
+	if c.IndexChecks {
+		hdr += 4
+	}
+	first = c.pc + hdr
+	if first%0x100+n > 0x100 {
+		cross = true
+		first += 2
+	}
+
+	if c.IndexChecks {
+		c.emit(0x3E, (0x100-n)&0xFF)
+		c.emit1(2, 0, 3)
+		c.emit(0x28, c.pc-1)
+		c.emit(0x3E, n%0x100)
+	}
+	c.emit(0x3E, first%0x100)
+	for b := 0; b < bits; b += 1 {
+		c.emit1(first>>(8+b)&1, b, pclath)
+	}
+	if cross {
+		c.emit1(2, 0, 3)
+		c.emit(0x0A, pclath+0x80)
+	}
+	c.emit(0, pcl+0x80)
+	for _, v := range data {
+		c.emit(0x34, v)
+	}
+	c.data = append(c.data, Range{first, c.pc - 1})
+}
+
+// Entry i of table x
+// A constant index gives the entry as a constant, otherwise the table is
+// called and the entry is returned in W
+func (c *Compiler) entry(x Object, i item) Object {
+	e := new(ObjDesc)
+	*e = *x
+	e.size = 0
+	if i.mode == Constant {
+		e.form = Constant
+		if i.a < len(x.data) {
+			e.a = x.data[i.a]
+		}
+		return e
+	}
+	c.load(i)
+	c.emit(0x20, x.a)
+	x.a = c.pc - 1
+	e.form = inW
+	return e
+}
+
+// Register holding the value of obj for a bit test
+// A table entry or a constant is put into a temporary first
+func (c *Compiler) testReg(obj Object) int {
+	if obj.form == inW || obj.form == Constant {
+		t := c.temp()
+		c.load(item{obj.form, obj.typ, obj.a})
+		c.emit(0, c.file(t)+0x80)
+		return t
+	}
+	return obj.a
+}
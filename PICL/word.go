@@ -0,0 +1,167 @@
+/*
+word.go: Code generation for the 16-bit WORD type
+Notes:
+1. A WORD occupies two registers, low byte first. w.L and w.H select the
+   bytes as INT variables
+2. W holds 8 bits only, so WORD expressions are computed in a pair of
+   temporary registers, the accumulator. + and - propagate the carry
+3. INT operands and constants widen to WORD. Numbers above 255 are WORD
+   constants, numbers above 65535 are rejected
+4. Relations compare the high bytes first and the low bytes only if these
+   are equal, which leaves carry and zero flags as for an 8-bit compare
+*/
+
+package PICL
+
+import (
+	"fmt"
+	"picl-go/PICS"
+)
+
+// Item mode of a WORD value in an accumulator, which may be updated in place
+const acc = 6
+
+// Get a pair of registers for a WORD accumulator
+// Allocated like the temporaries, see temp
+func (c *Compiler) pair() int {
+	if c.npairs == len(c.pairs) {
+		a := c.alloc([]byte("(temporary)"))
+		c.alloc([]byte("(temporary)"))
+		c.pairs = append(c.pairs, c.internalReg(a, fmt.Sprintf("_t%.2X", a), PICS.Word_t))
+	}
+	c.npairs += 1
+	return c.pairs[c.npairs-1]
+}
+
+// Is byte i of x known to be zero?
+func (c *Compiler) zero(x item, i int) bool {
+	if x.mode == Constant {
+		return (x.a>>(8*i))&0xFF == 0
+	}
+	return i > 0 && x.typ != PICS.Word_t
+}
+
+// Move byte i of x into W
+func (c *Compiler) loadByte(x item, i int) {
+	if x.mode == Constant {
+		c.emit(0x30, (x.a>>(8*i))&0xFF)
+	} else if c.zero(x, i) {
+		c.emit(0x30, 0)
+	} else if x.mode == Variable || x.mode == acc {
+		c.emit(0x08, c.file(x.a+i))
+	} else if x.mode != 0 {
+		c.Mark(10)
+	}
+}
+
+// Put down byte i of x minus W, into W
+func (c *Compiler) subByte(x item, i int) {
+	if x.mode == Constant {
+		c.emit(0x3C, (x.a>>(8*i))&0xFF)
+	} else if c.zero(x, i) {
+		c.emit(0x3C, 0)
+	} else if x.mode == Variable || x.mode == acc {
+		c.emit(0x02, c.file(x.a+i))
+	} else if x.mode != 0 {
+		c.Mark(10)
+	}
+}
+
+// Store x, widened to 16 bits, in the registers at a
+func (c *Compiler) store16(a int, x item) {
+	if x.mode == inW {
+		c.emit(0, c.file(a)+0x80)
+		c.emit(1, c.file(a+1)+0x80)
+		return
+	}
+	if x.mode == 0 {
+		return
+	}
+	for i := 0; i < 2; i += 1 {
+		if c.zero(x, i) {
+			c.emit(1, c.file(a+i)+0x80)
+		} else {
+			c.loadByte(x, i)
+			c.emit(0, c.file(a+i)+0x80)
+		}
+	}
+}
+
+// Put down x op y with at least one WORD operand
+func (c *Compiler) operation16(op int, x item, y item) item {
+	if (x.typ != PICS.Int_t && x.typ != PICS.Word_t && x.typ != 0) ||
+		(y.typ != PICS.Int_t && y.typ != PICS.Word_t && y.typ != 0) {
+		c.Mark(12)
+		return item{0, PICS.Word_t, 0}
+	}
+	if op != PICS.Plus && op != PICS.Minus {
+		c.Mark(30)
+		return item{0, PICS.Word_t, 0}
+	}
+	c.spill(&y)
+	if x.mode != acc {
+		t := c.pair()
+		c.store16(t, x)
+		x = item{acc, PICS.Word_t, t}
+	}
+	if op == PICS.Plus {
+		if !c.zero(y, 0) {
+			c.loadByte(y, 0)
+			c.emit(0x07, c.file(x.a)+0x80)
+			c.emit1(2, 0, 3)
+			c.emit(0x0A, c.file(x.a+1)+0x80)
+		}
+		if !c.zero(y, 1) {
+			c.loadByte(y, 1)
+			c.emit(0x07, c.file(x.a+1)+0x80)
+		}
+	} else {
+		if !c.zero(y, 0) {
+			c.loadByte(y, 0)
+			c.emit(0x02, c.file(x.a)+0x80)
+			c.emit1(3, 0, 3)
+			c.emit(0x03, c.file(x.a+1)+0x80)
+		}
+		if !c.zero(y, 1) {
+			c.loadByte(y, 1)
+			c.emit(0x02, c.file(x.a+1)+0x80)
+		}
+	}
+	return x
+}
+
+// Put down x - y for a relation with at least one WORD operand
+func (c *Compiler) compare16(x item, y item) {
+	var L int
+
+	c.spill(&x)
+	c.spill(&y)
+	c.loadByte(y, 1)
+	c.subByte(x, 1)
+	c.emit1(3, 2, 3)
+	L = c.jump(0)
+	c.loadByte(y, 0)
+	c.subByte(x, 0)
+	c.fixup(L, c.pc)
+}
+
+// INC, DEC, ROL and ROR of the WORD at a, cd as in Operand1
+func (c *Compiler) update16(cd int, a int) {
+	switch cd {
+	case 10:
+		c.emit(0x0A, c.file(a)+0x80)
+		c.emit1(2, 2, 3)
+		c.emit(0x0A, c.file(a+1)+0x80)
+	case 3:
+		c.emit(0x08, c.file(a)+0x80)
+		c.emit1(2, 2, 3)
+		c.emit(0x03, c.file(a+1)+0x80)
+		c.emit(0x03, c.file(a)+0x80)
+	case 13:
+		c.emit(0x0D, c.file(a)+0x80)
+		c.emit(0x0D, c.file(a+1)+0x80)
+	case 12:
+		c.emit(0x0C, c.file(a+1)+0x80)
+		c.emit(0x0C, c.file(a)+0x80)
+	}
+}
@@ -1,18 +1,20 @@
 /*
 PICS.go: The PICL Scanner
 Notes:
-1. Texts.Read(R, ch) -> ch, err = r.ReadByte()
+1. Texts.Read(R, ch) -> s.read(), which also tracks line and column
 2. No error checking!! This from the original source
 3. Go's init syntax used to set key & synmo, ditched Enter()
 4. Symbol constants are exported instead of duplicating in PICL
 5. Numeric type constants duplicated here
+6. All scanner state lives in a Scanner value, so several sources can be
+   scanned at the same time
 */
 
 package PICS
 
 import (
 	"bufio"
-	//"fmt"
+	"fmt"
 	"io"
 )
 
@@ -23,6 +25,7 @@ const (
 	Int_t  = 1
 	Set_t  = 2
 	Bool_t = 3
+	Word_t = 4
 )
 
 // Symbols
@@ -35,6 +38,7 @@ const (
 	Not       = 5
 	And       = 6
 	Or        = 7
+	Mod       = 8
 	Eql       = 10
 	Neq       = 11
 	Geq       = 12
@@ -44,6 +48,7 @@ const (
 	Period    = 16
 	Comma     = 17
 	Colon     = 18
+	Lbrak     = 19
 	Op        = 20
 	Query     = 21
 	Lparen    = 22
@@ -69,58 +74,95 @@ const (
 	Int       = 42
 	Set       = 43
 	Bool      = 44
+	Word      = 45
+	Rbrak     = 46
+	Of        = 47
+	Array     = 48
+	Table     = 49
 	Const     = 50
 	Begin     = 51
 	Proced    = 52
 	Module    = 53
 	Eof       = 54
+	Config    = 55
+	EEPROM    = 56
+	Asm       = 57
 )
 
-var (
-	ch  byte
-	err error
-	r   *bufio.Reader
-	Val int
-	Typ int
-	Id  []byte
-)
+// Source position, lines and columns count from 1
+// Off is the byte offset, used to measure the distance between positions
+type Pos struct {
+	Line, Col, Off int
+}
+
+func (p Pos) String() string {
+	return fmt.Sprintf("%d:%d", p.Line, p.Col)
+}
+
+// Scanner holds the state of one pass over a source text
+type Scanner struct {
+	ch        byte
+	err       error
+	r         io.ByteReader
+	line, col int
+	off       int
+	Pos       Pos // start of the last symbol
+	Val       int
+	Typ       int
+	Id        []byte
+}
+
+// Read the next character, keeping track of its position
+func (s *Scanner) read() {
+	if s.ch == '\n' {
+		s.line += 1
+		s.col = 0
+	}
+	s.ch, s.err = s.r.ReadByte()
+	s.col += 1
+	s.off += 1
+}
 
 // key & symno are the table of recognised symbols in the PICL grammar
 // NOTE!! must be sorted, binary search is used
 var key = [...]string{
-	"BEGIN", "BOOL", "CONST", "DEC",
-	"DO", "ELSE", "ELSIF", "END",
-	"IF", "INC", "INT", "MODULE",
-	"OR", "PROCEDURE", "REPEAT", "RETURN",
-	"ROL", "ROR", "SET", "THEN",
-	"UNTIL", "WHILE", "~ ",
+	"ARRAY", "ASM", "BEGIN", "BOOL",
+	"CONFIG", "CONST", "DEC", "DO",
+	"EEPROM", "ELSE", "ELSIF", "END",
+	"IF", "INC", "INT", "MOD",
+	"MODULE", "OF", "OR", "PROCEDURE",
+	"REPEAT", "RETURN", "ROL", "ROR",
+	"SET", "TABLE", "THEN", "UNTIL",
+	"WHILE", "WORD", "~ ",
 }
 var symno = [...]int{
-	Begin, Bool, Const, Dec,
-	Do, Else, Elsif, End,
-	If, Inc, Int, Module,
-	Or, Proced, Repeat, Return,
-	Rol, Ror, Set, Then,
-	Until, While,
+	Array, Asm, Begin, Bool,
+	Config, Const, Dec, Do,
+	EEPROM, Else, Elsif, End,
+	If, Inc, Int, Mod,
+	Module, Of, Or, Proced,
+	Repeat, Return, Rol, Ror,
+	Set, Table, Then, Until,
+	While, Word,
 }
 
 // Handle identifiers and keywords
-func identifier() int {
+func (s *Scanner) identifier() int {
 	// Zero out last usage
-	Id = Id[:0]
+	s.Id = s.Id[:0]
 	i := 0
 
 	// Read in contiguous alphanum chars
 	for {
 		if i < 16 {
-			Id = append(Id, ch)
+			s.Id = append(s.Id, s.ch)
 			i += 1
 		}
-		ch, _ = r.ReadByte()
-		if (ch < '0') ||
-			(ch > '9' && ch < 'A') ||
-			(ch > 'Z' && ch < 'a') ||
-			(ch > 'z') {
+		s.read()
+		if (s.ch < '0') ||
+			(s.ch > '9' && s.ch < 'A') ||
+			(s.ch > 'Z' && s.ch < 'a') ||
+			(s.ch > 'z') {
 			break
 		}
 	}
@@ -131,7 +173,7 @@ func identifier() int {
 	for i < j {
 		// binary search
 		m := (i + j) / 2
-		if key[m] < string(Id[:]) {
+		if key[m] < string(s.Id[:]) {
 			i = m + 1
 		} else {
 			j = m
@@ -139,152 +181,159 @@ func identifier() int {
 	}
 
 	// Identifier or keyword?
-	if key[j] == string(Id[:]) {
+	if key[j] == string(s.Id[:]) {
 		return symno[i]
 	}
 	return Ident
 }
 
 // Get a decimal number
-func number() {
-	Val = 0
+func (s *Scanner) number() {
+	s.Val = 0
 	for {
-		Val = 10*Val + int(ch-'0')
-		ch, err = r.ReadByte()
-		if (ch < '0') || (ch > '9') {
+		s.Val = 10*s.Val + int(s.ch-'0')
+		s.read()
+		if (s.ch < '0') || (s.ch > '9') {
 			break
 		}
 	}
 }
 
 // Helper for hex()
-func getDigit() int {
+func (s *Scanner) getDigit() int {
 	var d int
 
-	if (ch >= '0') && (ch <= '9') {
-		d = int(ch - '0')
-	} else if ch >= 'A' && ch <= 'F' {
-		d = int(ch - '7')
+	if (s.ch >= '0') && (s.ch <= '9') {
+		d = int(s.ch - '0')
+	} else if s.ch >= 'A' && s.ch <= 'F' {
+		d = int(s.ch - '7')
 	} else {
 		d = 0
 	}
-	ch, err = r.ReadByte()
+	s.read()
 
 	return d
 }
 
 // Get a SET literal ($xx)
-func hex() {
-	Val = getDigit()<<4 | getDigit()
+func (s *Scanner) hex() {
+	s.Val = s.getDigit()<<4 | s.getDigit()
 }
 
 // Return next symbol in input
-func Get(sym *int) {
+func (s *Scanner) Get(sym *int) {
 	// Eat whitespace or anything enclosed in {}
-	for (ch <= ' ') || (ch == '{') {
-		if ch == '{' {
+	for s.err == nil && ((s.ch <= ' ') || (s.ch == '{')) {
+		if s.ch == '{' {
 			for {
-				ch, err = r.ReadByte()
-				if (ch == '}') || (err == io.EOF) {
+				s.read()
+				if (s.ch == '}') || (s.err == io.EOF) {
 					break
 				}
 			}
 		}
-		ch, _ = r.ReadByte()
+		s.read()
 	}
 	// Repeat until a valid symbol is found (this includes EOF)
 	for {
 		// Eat whitespace
-		for err != io.EOF && (ch <= ' ') {
-			ch, err = r.ReadByte()
+		for s.err == nil && (s.ch <= ' ') {
+			s.read()
 		}
 		// Recognise symbol
-		if err == io.EOF {
+		s.Pos = Pos{s.line, s.col, s.off}
+		if s.err != nil {
 			*sym = Eof
 		} else {
 			switch {
-			case ch == '!':
-				ch, err = r.ReadByte()
+			case s.ch == '!':
+				s.read()
 				*sym = Op
-			case ch == '#':
-				ch, err = r.ReadByte()
+			case s.ch == '#':
+				s.read()
 				*sym = Neq
-			case ch == '$':
-				ch, err = r.ReadByte()
-				hex()
+			case s.ch == '$':
+				s.read()
+				s.hex()
 				*sym = Number
-				Typ = Set_t
-			case ch == '&':
-				ch, err = r.ReadByte()
+				s.Typ = Set_t
+			case s.ch == '&':
+				s.read()
 				*sym = And
-			case ch == '(':
-				ch, err = r.ReadByte()
+			case s.ch == '(':
+				s.read()
 				*sym = Lparen
-			case ch == ')':
-				ch, err = r.ReadByte()
+			case s.ch == ')':
+				s.read()
 				*sym = Rparen
-			case ch == '*':
-				ch, err = r.ReadByte()
+			case s.ch == '*':
+				s.read()
 				*sym = Ast
-			case ch == '+':
-				ch, err = r.ReadByte()
+			case s.ch == '+':
+				s.read()
 				*sym = Plus
-			case ch == ',':
-				ch, err = r.ReadByte()
+			case s.ch == ',':
+				s.read()
 				*sym = Comma
-			case ch == '-':
-				ch, err = r.ReadByte()
+			case s.ch == '-':
+				s.read()
 				*sym = Minus
-			case ch == '.':
-				ch, err = r.ReadByte()
+			case s.ch == '.':
+				s.read()
 				*sym = Period
-			case ch == '/':
-				ch, err = r.ReadByte()
+			case s.ch == '/':
+				s.read()
 				*sym = Slash
-			case ch >= '0' && ch <= '9':
-				number()
+			case s.ch >= '0' && s.ch <= '9':
+				s.number()
 				*sym = Number
-				Typ = Int_t
-			case ch == ':':
-				ch, err = r.ReadByte()
-				if ch == '=' {
-					ch, err = r.ReadByte()
+				s.Typ = Int_t
+			case s.ch == ':':
+				s.read()
+				if s.ch == '=' {
+					s.read()
 					*sym = Becomes
 				} else {
 					*sym = Colon
 				}
-			case ch == ';':
-				ch, err = r.ReadByte()
+			case s.ch == ';':
+				s.read()
 				*sym = Semicolon
-			case ch == '<':
-				ch, err = r.ReadByte()
-				if ch == '=' {
-					ch, err = r.ReadByte()
+			case s.ch == '<':
+				s.read()
+				if s.ch == '=' {
+					s.read()
 					*sym = Leq
 				} else {
 					*sym = Lss
 				}
-			case ch == '=':
-				ch, err = r.ReadByte()
+			case s.ch == '=':
+				s.read()
 				*sym = Eql
-			case ch == '>':
-				ch, err = r.ReadByte()
-				if ch == '=' {
-					ch, err = r.ReadByte()
+			case s.ch == '>':
+				s.read()
+				if s.ch == '=' {
+					s.read()
 					*sym = Geq
 				} else {
 					*sym = Gtr
 				}
-			case ch == '?':
-				ch, err = r.ReadByte()
+			case s.ch == '?':
+				s.read()
 				*sym = Query
-			case ch == '~':
-				ch, err = r.ReadByte()
+			case s.ch == '[':
+				s.read()
+				*sym = Lbrak
+			case s.ch == ']':
+				s.read()
+				*sym = Rbrak
+			case s.ch == '~':
+				s.read()
 				*sym = Not
-			case (ch >= 'A' && ch <= 'Z') || (ch >= 'a' && ch <= 'z'):
-				*sym = identifier()
+			case (s.ch >= 'A' && s.ch <= 'Z') || (s.ch >= 'a' && s.ch <= 'z'):
+				*sym = s.identifier()
 			default:
-				ch, err = r.ReadByte()
+				s.read()
 				*sym = Null
 			}
 		}
@@ -296,13 +345,54 @@ func Get(sym *int) {
 	//fmt.Printf("Gets(): sym = %d\n", *sym)
 }
 
-// Scanner init
-func Init(reader *bufio.Reader) {
-	r = reader
-	ch, _ = r.ReadByte()
+// Raw source text up to the word END at the start of a line, for an ASM
+// block after the symbol ASM. Comments start with ; and run to the end of
+// the line. False if the text runs to the end of the file. The next symbol
+// is the one after END
+func (s *Scanner) Text() ([]byte, bool) {
+	var text []byte
+	comment := false
+	first := true // no word on the line yet
+
+	for s.err == nil {
+		switch {
+		case s.ch == '\n':
+			comment = false
+			first = true
+		case s.ch == ';':
+			comment = true
+		case !comment && (s.ch == '_' || (s.ch >= 'A' && s.ch <= 'Z') || (s.ch >= 'a' && s.ch <= 'z')):
+			n := len(text)
+			for s.err == nil && (s.ch == '_' || s.ch == '?' || (s.ch >= '0' && s.ch <= '9') ||
+				(s.ch >= 'A' && s.ch <= 'Z') || (s.ch >= 'a' && s.ch <= 'z')) {
+				text = append(text, s.ch)
+				s.read()
+			}
+			if first && string(text[n:]) == "END" {
+				return text[:n], true
+			}
+			first = false
+			continue
+		case !comment && s.ch > ' ':
+			first = false
+		}
+		text = append(text, s.ch)
+		s.read()
+	}
+	return text, false
 }
 
-// Run once at startup
-func init() {
-	Id = make([]byte, 16)
+// Scanner init
+func NewScanner(reader io.Reader) *Scanner {
+	s := new(Scanner)
+	if br, ok := reader.(io.ByteReader); ok {
+		s.r = br
+	} else {
+		s.r = bufio.NewReader(reader)
+	}
+	s.Id = make([]byte, 0, 16)
+	s.line = 1
+	s.off = -1
+	s.read()
+	return s
 }
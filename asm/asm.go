@@ -0,0 +1,431 @@
+/*
+asm.go: Assembler for the mid-range PIC16 instruction set
+Notes:
+1. One statement per line: [label[:]] [mnemonic [operand, ...]] [; comment]
+   A label is a name ending in a colon, or a name in column 1 that is not
+   a mnemonic or directive. Mnemonics and directives are not case
+   sensitive, names are
+2. Operands are expressions of numbers, names and $, the address of the
+   statement, joined by + and -. Numbers are decimal unless written 0x1F,
+   $1F, H'1F', 0b101, B'101', D'31' or 'c'
+3. Register operands take the low 7 bits of the address, GOTO and CALL the
+   low 11 bits of the target, as MPASM does. The bank and page bits are up
+   to the program. The full register addresses are kept with the code, so
+   that the caller can check the banks
+4. Directives: name EQU value, ORG address, DW, DT and DE lists, __CONFIG
+   value, PROCESSOR and END. DT puts down RETLW for each value, DE one
+   byte per word, eg for the data EEPROM at 0x2100
+5. Two passes: the first gives the labels their addresses, the second puts
+   down the code. ORG must not depend on labels further down
+*/
+
+package asm
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Operand forms
+const (
+	none    = iota
+	byteOp  // f,d
+	fileOp  // f, MOVWF and CLRF
+	bitOp   // f,b
+	branch  // k, 11 bits
+	literal // k, 8 bits
+)
+
+// Instructions: operand form and opcode with all operand bits zero
+var instructions = map[string]struct {
+	form, op int
+}{
+	"ADDWF": {byteOp, 0x0700}, "ANDWF": {byteOp, 0x0500}, "CLRF": {fileOp, 0x0180},
+	"CLRW": {none, 0x0103}, "COMF": {byteOp, 0x0900}, "DECF": {byteOp, 0x0300},
+	"DECFSZ": {byteOp, 0x0B00}, "INCF": {byteOp, 0x0A00}, "INCFSZ": {byteOp, 0x0F00},
+	"IORWF": {byteOp, 0x0400}, "MOVF": {byteOp, 0x0800}, "MOVWF": {fileOp, 0x0080},
+	"NOP": {none, 0x0000}, "RLF": {byteOp, 0x0D00}, "RRF": {byteOp, 0x0C00},
+	"SUBWF": {byteOp, 0x0200}, "SWAPF": {byteOp, 0x0E00}, "XORWF": {byteOp, 0x0600},
+	"BCF": {bitOp, 0x1000}, "BSF": {bitOp, 0x1400}, "BTFSC": {bitOp, 0x1800},
+	"BTFSS": {bitOp, 0x1C00},
+	"ADDLW": {literal, 0x3E00}, "ANDLW": {literal, 0x3900}, "CALL": {branch, 0x2000},
+	"CLRWDT": {none, 0x0064}, "GOTO": {branch, 0x2800}, "IORLW": {literal, 0x3800},
+	"MOVLW": {literal, 0x3000}, "RETFIE": {none, 0x0009}, "RETLW": {literal, 0x3400},
+	"RETURN": {none, 0x0008}, "SLEEP": {none, 0x0063}, "SUBLW": {literal, 0x3C00},
+	"XORLW": {literal, 0x3A00},
+}
+
+var directives = map[string]bool{
+	"EQU": true, "ORG": true, "DW": true, "DT": true, "DE": true,
+	"__CONFIG": true, "PROCESSOR": true, "END": true,
+}
+
+// Is name a mnemonic or directive?
+func Reserved(name string) bool {
+	n := strings.ToUpper(name)
+	_, ok := instructions[n]
+	return ok || directives[n] || n == "W" || n == "F"
+}
+
+// Segment is a run of words from Addr on, Lines gives the source line of
+// each word and Regs its register operand, the full address, or -1
+type Segment struct {
+	Addr  int
+	Words []int
+	Lines []int
+	Regs  []int
+}
+
+// Error in line Line of the source
+type Error struct {
+	Line int
+	Msg  string
+}
+
+func (e Error) Error() string {
+	return fmt.Sprintf("%d: %s", e.Line, e.Msg)
+}
+
+// Assembler holds the names known in operands and the target specifics
+type Assembler struct {
+	Symbols    map[string]int // predeclared names, eg registers
+	ConfigAddr int            // address of the configuration word
+
+	syms    map[string]int  // predeclared names, labels and EQUs
+	defined map[string]bool // labels and EQUs of the current pass
+	pc      int
+	line    int
+	segs    []Segment
+	errs    []Error
+	pass    int
+}
+
+func New() *Assembler {
+	return &Assembler{Symbols: make(map[string]int), ConfigAddr: 0x2007}
+}
+
+// Errors are reported in the second pass, the first one finds them too
+func (a *Assembler) errorf(format string, args ...interface{}) {
+	if a.pass == 2 {
+		a.errs = append(a.errs, Error{a.line, fmt.Sprintf(format, args...)})
+	}
+}
+
+// Assemble src, starting at address org
+// Returns the code in order of ORG, and all errors found
+func (a *Assembler) Assemble(src []byte, org int) ([]Segment, []Error) {
+	a.syms = make(map[string]int)
+	for k, v := range a.Symbols {
+		a.syms[k] = v
+	}
+	a.errs = nil
+	lines := strings.Split(string(src), "\n")
+	for a.pass = 1; a.pass <= 2; a.pass += 1 {
+		a.defined = make(map[string]bool)
+		a.pc = org
+		a.segs = []Segment{{Addr: org}}
+		for i, text := range lines {
+			a.line = i + 1
+			if !a.statement(strings.TrimRight(text, "\r")) {
+				break
+			}
+		}
+	}
+	var segs []Segment
+	for _, s := range a.segs {
+		if len(s.Words) > 0 {
+			segs = append(segs, s)
+		}
+	}
+	return segs, a.errs
+}
+
+// Put down word w at pc
+func (a *Assembler) put(w int) {
+	s := &a.segs[len(a.segs)-1]
+	s.Words = append(s.Words, w)
+	s.Lines = append(s.Lines, a.line)
+	s.Regs = append(s.Regs, -1)
+	a.pc += 1
+}
+
+// Define name, a label or EQU
+func (a *Assembler) define(name string, v int) {
+	if !validName(name) || Reserved(name) {
+		a.errorf("bad name %s", name)
+		return
+	}
+	if a.defined[name] {
+		a.errorf("%s defined twice", name)
+	}
+	a.defined[name] = true
+	a.syms[name] = v
+}
+
+func validName(name string) bool {
+	for i, ch := range name {
+		letter := ch == '_' || ch == '?' || (ch >= 'A' && ch <= 'Z') || (ch >= 'a' && ch <= 'z')
+		if !letter && (i == 0 || ch < '0' || ch > '9') {
+			return false
+		}
+	}
+	return name != ""
+}
+
+// Split a line into fields: label, mnemonic and operands, without the
+// comment
+func fields(text string) (label string, mnem string, ops []string) {
+	quote := false
+	for i, ch := range text {
+		if ch == '\'' {
+			quote = !quote
+		} else if ch == ';' && !quote {
+			text = text[:i]
+			break
+		}
+	}
+	rest := text
+	word := func() string {
+		rest = strings.TrimLeft(rest, " \t")
+		i := strings.IndexAny(rest, " \t")
+		if i < 0 {
+			i = len(rest)
+		}
+		w := rest[:i]
+		rest = rest[i:]
+		return w
+	}
+
+	w := word()
+	if w == "" {
+		return
+	}
+	after := rest
+	next := word()
+	rest = after
+	if strings.HasSuffix(w, ":") {
+		label = strings.TrimSuffix(w, ":")
+		w = word()
+	} else if strings.ToUpper(next) == "EQU" || (text[0] != ' ' && text[0] != '\t' && !Reserved(w)) {
+		label = w
+		w = word()
+	}
+	mnem = strings.ToUpper(w)
+
+	if rest = strings.TrimSpace(rest); rest != "" {
+		start := 0
+		quote = false
+		for i, ch := range rest {
+			if ch == '\'' {
+				quote = !quote
+			} else if ch == ',' && !quote {
+				ops = append(ops, strings.TrimSpace(rest[start:i]))
+				start = i + 1
+			}
+		}
+		ops = append(ops, strings.TrimSpace(rest[start:]))
+	}
+	return
+}
+
+// Assemble one line, false at END
+func (a *Assembler) statement(text string) bool {
+	label, mnem, ops := fields(text)
+	if mnem == "EQU" {
+		if len(ops) != 1 {
+			a.errorf("EQU takes one value")
+			return true
+		}
+		if v, ok := a.value(ops[0]); ok {
+			a.define(label, v)
+		}
+		return true
+	}
+	if label != "" {
+		a.define(label, a.pc)
+	}
+	if mnem == "" {
+		return true
+	}
+
+	if ins, ok := instructions[mnem]; ok {
+		a.instruction(mnem, ins.form, ins.op, ops)
+		return true
+	}
+	switch mnem {
+	case "ORG":
+		if len(ops) != 1 {
+			a.errorf("ORG takes one address")
+		} else if v, ok := a.value(ops[0]); ok {
+			a.pc = v
+			a.segs = append(a.segs, Segment{Addr: v})
+		}
+	case "__CONFIG":
+		if len(ops) != 1 {
+			a.errorf("__CONFIG takes one value")
+		} else {
+			pc := a.pc
+			a.segs = append(a.segs, Segment{Addr: a.ConfigAddr})
+			a.put(a.number(ops[0], 0x3FFF))
+			a.pc = pc
+			a.segs = append(a.segs, Segment{Addr: pc})
+		}
+	case "DW", "DT", "DE":
+		if len(ops) == 0 {
+			a.errorf("values expected after %s", mnem)
+		}
+		for _, op := range ops {
+			switch mnem {
+			case "DW":
+				a.put(a.number(op, 0x3FFF))
+			case "DT":
+				a.put(0x3400 | a.number(op, 0xFF))
+			case "DE":
+				a.put(a.number(op, 0xFF))
+			}
+		}
+	case "PROCESSOR":
+	case "END":
+		return false
+	default:
+		a.errorf("unknown mnemonic %s", mnem)
+	}
+	return true
+}
+
+// Put down an instruction
+func (a *Assembler) instruction(mnem string, form int, op int, ops []string) {
+	want := [...]int{none: 0, byteOp: 2, fileOp: 1, bitOp: 2, branch: 1, literal: 1}[form]
+	if form == byteOp && len(ops) == 1 {
+		// Destination F by default, as with MPASM
+		ops = append(ops, "F")
+	}
+	if len(ops) != want {
+		a.errorf("%s takes %d operand(s)", mnem, want)
+		a.put(op)
+		return
+	}
+	reg := -1
+	switch form {
+	case byteOp:
+		d := 0
+		switch strings.ToUpper(ops[1]) {
+		case "W", "0":
+			d = 0
+		case "F", "1":
+			d = 0x80
+		default:
+			a.errorf("destination W or F expected")
+		}
+		reg = a.number(ops[0], 0x1FF)
+		op |= d | reg&0x7F
+	case fileOp:
+		reg = a.number(ops[0], 0x1FF)
+		op |= reg & 0x7F
+	case bitOp:
+		reg = a.number(ops[0], 0x1FF)
+		op |= a.number(ops[1], 7)<<7 | reg&0x7F
+	case branch:
+		op |= a.number(ops[0], 0x1FFF) & 0x7FF
+	case literal:
+		op |= a.number(ops[0], 0xFF)
+	}
+	a.put(op)
+	s := &a.segs[len(a.segs)-1]
+	s.Regs[len(s.Regs)-1] = reg
+}
+
+// Value of an operand, at most max
+// Bytes may be given as negative numbers down to -128, they are taken
+// modulo 256
+func (a *Assembler) number(s string, max int) int {
+	v, ok := a.value(s)
+	if !ok {
+		return 0
+	}
+	if (v < 0 && max != 0xFF) || v < -128 || v > max {
+		a.errorf("%s out of range", s)
+	}
+	return v & max
+}
+
+// Value of an expression, false if it is not known
+// In the first pass labels further down are not known yet
+func (a *Assembler) value(s string) (int, bool) {
+	v, sign := 0, 1
+	s = strings.TrimSpace(s)
+	if s == "" {
+		a.errorf("operand expected")
+		return 0, false
+	}
+	for s != "" {
+		if s[0] == '+' || s[0] == '-' {
+			if s[0] == '-' {
+				sign = -sign
+			}
+			s = strings.TrimSpace(s[1:])
+			continue
+		}
+		n := termLen(s)
+		t, ok := a.term(s[:n])
+		if !ok {
+			a.errorf("%s undefined or not a number", s[:n])
+			return 0, false
+		}
+		v += sign * t
+		sign = 1
+		s = strings.TrimSpace(s[n:])
+		if s != "" && s[0] != '+' && s[0] != '-' {
+			a.errorf("+ or - expected before %s", s)
+			return 0, false
+		}
+	}
+	return v, true
+}
+
+// Length of the term at the start of s
+func termLen(s string) int {
+	if s[0] == '\'' || (len(s) > 1 && s[1] == '\'') {
+		if k := strings.IndexByte(s[2:], '\''); k >= 0 {
+			return k + 3
+		}
+		return len(s)
+	}
+	n := 1
+	for n < len(s) && s[n] != '+' && s[n] != '-' && s[n] != ' ' && s[n] != '\t' {
+		n += 1
+	}
+	return n
+}
+
+// Value of a number or name
+func (a *Assembler) term(t string) (int, bool) {
+	var v int64
+	var err error
+
+	switch {
+	case t == "$":
+		return a.pc, true
+	case len(t) == 3 && t[0] == '\'' && t[2] == '\'':
+		return int(t[1]), true
+	case len(t) > 3 && t[1] == '\'' && t[len(t)-1] == '\'':
+		base := map[byte]int{'H': 16, 'B': 2, 'D': 10, 'O': 8}[t[0]&^0x20]
+		if base == 0 {
+			return 0, false
+		}
+		v, err = strconv.ParseInt(t[2:len(t)-1], base, 32)
+	case strings.HasPrefix(t, "0x") || strings.HasPrefix(t, "0X"):
+		v, err = strconv.ParseInt(t[2:], 16, 32)
+	case strings.HasPrefix(t, "0b") || strings.HasPrefix(t, "0B"):
+		v, err = strconv.ParseInt(t[2:], 2, 32)
+	case t[0] == '$':
+		v, err = strconv.ParseInt(t[1:], 16, 32)
+	case t[0] >= '0' && t[0] <= '9':
+		v, err = strconv.ParseInt(t, 10, 32)
+	default:
+		n, ok := a.syms[t]
+		return n, ok
+	}
+	return int(v), err == nil
+}
@@ -0,0 +1,146 @@
+package asm
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+)
+
+// Assemble src at 0 with the registers of the 16F688 used below
+func assemble(src string) ([]Segment, []Error) {
+	a := New()
+	a.Symbols["STATUS"] = 3
+	a.Symbols["TRISA"] = 0x85
+	return a.Assemble([]byte(src), 0)
+}
+
+var encodings = []struct {
+	src  string
+	code []int
+}{
+	{"\tADDWF 0x20,W", []int{0x0720}},
+	{"\tADDWF 0x20,F", []int{0x07A0}},
+	{"\tINCF 0x21", []int{0x0AA1}},
+	{"\tDECFSZ 0x21,0", []int{0x0B21}},
+	{"\tMOVF 0x22,1", []int{0x08A2}},
+	{"\tmovwf 0x7F", []int{0x00FF}},
+	{"\tCLRF TRISA", []int{0x0185}},
+	{"\tCLRW\n\tNOP\n\tRETURN\n\tRETFIE\n\tSLEEP\n\tCLRWDT", []int{0x0103, 0x0000, 0x0008, 0x0009, 0x0063, 0x0064}},
+	{"\tBCF STATUS,5", []int{0x1283}},
+	{"\tBSF STATUS,6", []int{0x1703}},
+	{"\tBTFSC STATUS,2\n\tBTFSS STATUS,0", []int{0x1903, 0x1C03}},
+	{"\tMOVLW 0x30\n\tRETLW 'A'\n\tADDLW -1\n\tSUBLW 200", []int{0x3030, 0x3441, 0x3EFF, 0x3CC8}},
+	{"\tANDLW 0b1010\n\tIORLW B'11'\n\tXORLW H'1F'\n\tMOVLW D'31'", []int{0x390A, 0x3803, 0x3A1F, 0x301F}},
+	{"\tMOVLW $1F\n\tMOVLW 0X1f", []int{0x301F, 0x301F}},
+	{"\tGOTO 0x123\n\tCALL 0x0FFF", []int{0x2923, 0x27FF}},
+	{"\tGOTO $\n\tGOTO $-1", []int{0x2800, 0x2800}},
+	{"loop\tDECFSZ 0x20,F\n\tGOTO loop\nnext: RETURN\n\tCALL next", []int{0x0BA0, 0x2800, 0x0008, 0x2002}},
+	{"\tGOTO done\n\tNOP\ndone: GOTO done", []int{0x2802, 0x0000, 0x2802}},
+	{"n EQU 0x20\nm equ n+2\n\tMOVWF m\n\tMOVLW n-1", []int{0x00A2, 0x301F}},
+	{"\tDW 0x3FFF, 1\n\tDT 1, 'b'\n\tDE 0x41", []int{0x3FFF, 0x0001, 0x3401, 0x3462, 0x0041}},
+	{"\tMOVLW ';' ; comment\n\tPROCESSOR 16F688", []int{0x303B}},
+	{"\tNOP\n\tEND\n\tNOP", []int{0x0000}},
+}
+
+func TestEncodings(t *testing.T) {
+	for _, tt := range encodings {
+		segs, errs := assemble(tt.src)
+		if len(errs) > 0 {
+			t.Errorf("%q: errors %v", tt.src, errs)
+		} else if len(segs) != 1 || fmt.Sprintf("%#x", segs[0].Words) != fmt.Sprintf("%#x", tt.code) {
+			t.Errorf("%q: code %v, want %#x", tt.src, segs, tt.code)
+		}
+	}
+}
+
+func TestSegments(t *testing.T) {
+	segs, errs := assemble("\tGOTO start\n\tORG 4\nstart:\tNOP\n\t__CONFIG 0x30C4\n\tCALL start\n\tORG 0x2100\n\tDE 7")
+	if len(errs) > 0 {
+		t.Fatal(errs)
+	}
+	want := []struct {
+		addr  int
+		words []int
+		lines []int
+	}{
+		{0, []int{0x2804}, []int{1}},
+		{4, []int{0x0000}, []int{3}},
+		{0x2007, []int{0x30C4}, []int{4}},
+		{5, []int{0x2004}, []int{5}},
+		{0x2100, []int{0x0007}, []int{7}},
+	}
+	if len(segs) != len(want) {
+		t.Fatalf("%d segments, want %d: %v", len(segs), len(want), segs)
+	}
+	for i, w := range want {
+		s := segs[i]
+		if s.Addr != w.addr || fmt.Sprint(s.Words) != fmt.Sprint(w.words) || fmt.Sprint(s.Lines) != fmt.Sprint(w.lines) {
+			t.Errorf("segment %d: %#x %#x lines %v, want %#x %#x lines %v", i, s.Addr, s.Words, s.Lines, w.addr, w.words, w.lines)
+		}
+	}
+}
+
+// Register operands are kept at their full address, the code has the low
+// 7 bits
+func TestRegs(t *testing.T) {
+	segs, _ := assemble("\tBSF STATUS,5\n\tMOVWF TRISA\n\tMOVLW 0x85\n\tGOTO 0\n\tDECF 0x1A0,W")
+	want := []int{3, 0x85, -1, -1, 0x1A0}
+	if s := segs[0]; fmt.Sprint(s.Regs) != fmt.Sprint(want) {
+		t.Errorf("registers %#x, want %#x", s.Regs, want)
+	}
+	if w := segs[0].Words[4]; w != 0x0320 {
+		t.Errorf("DECF 0x1A0,W is %#.4x, want 0x0320", w)
+	}
+}
+
+func TestErrors(t *testing.T) {
+	for _, tt := range []struct {
+		src, err string
+	}{
+		{"\tFOO 1", "1: unknown mnemonic FOO"},
+		{"\tMOVLW", "1: MOVLW takes 1 operand(s)"},
+		{"\tBCF 3", "1: BCF takes 2 operand(s)"},
+		{"\tADDWF 0x20,X", "1: destination W or F expected"},
+		{"\tMOVLW 256", "1: 256 out of range"},
+		{"\tMOVLW -129", "1: -129 out of range"},
+		{"\tMOVWF 0x200", "1: 0x200 out of range"},
+		{"\tBSF 3,8", "1: 8 out of range"},
+		{"\tGOTO -1", "1: -1 out of range"},
+		{"\tGOTO nowhere", "1: nowhere undefined or not a number"},
+		{"\tMOVLW 1 2", "1: + or - expected before 2"},
+		{"\tMOVLW Q'1'", "1: Q'1' undefined or not a number"},
+		{"x: NOP\nx: NOP", "2: x defined twice"},
+		{"movlw: NOP", "1: bad name movlw"},
+		{"n EQU", "1: EQU takes one value"},
+		{"\tORG", "1: ORG takes one address"},
+		{"\t__CONFIG 1, 2", "1: __CONFIG takes one value"},
+		{"\tDT", "1: values expected after DT"},
+	} {
+		_, errs := assemble(tt.src)
+		var msgs []string
+		for _, e := range errs {
+			msgs = append(msgs, e.Error())
+		}
+		if strings.Join(msgs, "; ") != tt.err {
+			t.Errorf("%q: errors %q, want %q", tt.src, msgs, tt.err)
+		}
+	}
+}
+
+func TestFields(t *testing.T) {
+	for _, tt := range []struct {
+		text, label, mnem, ops string
+	}{
+		{"loop DECFSZ n, F ; count", "loop", "DECFSZ", "[n F]"},
+		{"\tmovlw ','", "", "MOVLW", "[',']"},
+		{"start:", "start", "", "[]"},
+		{"  n  EQU 5", "n", "EQU", "[5]"},
+		{"NOP", "", "NOP", "[]"},
+		{"; only a comment", "", "", "[]"},
+	} {
+		label, mnem, ops := fields(tt.text)
+		if label != tt.label || mnem != tt.mnem || fmt.Sprint(ops) != tt.ops {
+			t.Errorf("%q: %q %q %v, want %q %q %s", tt.text, label, mnem, ops, tt.label, tt.mnem, tt.ops)
+		}
+	}
+}
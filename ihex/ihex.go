@@ -0,0 +1,239 @@
+/*
+ihex.go: Intel HEX files
+Notes:
+1. A record has 6 fields, all ASCII characters (2 chars per byte):
+     : ll aaaa tt dd dd dd .... cc
+   ll = number of data bytes, aaaa = low 16 bits of the address,
+   tt = record type, dd = data bytes, cc = checksum, the two's complement
+   of the sum of all the other bytes
+2. Addresses are byte addresses. Type 04 records give the upper 16 bits of
+   the addresses that follow, 0 until the first one
+3. PIC16 program words are stored low byte first at twice their word
+   address, see WriteWords and Image.Word
+*/
+
+package ihex
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+)
+
+// Record types
+const (
+	Data        = 0x00
+	EOF         = 0x01
+	ExtSegment  = 0x02 // segment base address, upper address bits 4-19
+	StartSeg    = 0x03
+	ExtLinear   = 0x04 // upper 16 bits of the address
+	StartLinear = 0x05
+)
+
+// Writer puts down data as HEX records
+// The first error sticks, it is returned by all further calls
+type Writer struct {
+	RecLen int // data bytes per record, 16 unless set
+
+	w     io.Writer
+	upper int // upper address bits in effect
+	err   error
+}
+
+func NewWriter(w io.Writer) *Writer {
+	return &Writer{RecLen: 16, w: w}
+}
+
+// Put down one record
+func (w *Writer) record(typ int, addr int, data []byte) {
+	if w.err != nil {
+		return
+	}
+	sum := len(data) + addr>>8&0xFF + addr&0xFF + typ
+	var b strings.Builder
+	fmt.Fprintf(&b, ":%.2X%.4X%.2X", len(data), addr&0xFFFF, typ)
+	for _, d := range data {
+		fmt.Fprintf(&b, "%.2X", d)
+		sum += int(d)
+	}
+	fmt.Fprintf(&b, "%.2X\n", -sum&0xFF)
+	_, w.err = io.WriteString(w.w, b.String())
+}
+
+// Write data starting at byte address addr
+// Records do not cross 64K boundaries, type 04 records are put down when
+// the upper address bits change
+func (w *Writer) Write(addr int, data []byte) error {
+	for len(data) > 0 {
+		if addr>>16 != w.upper {
+			w.upper = addr >> 16
+			w.record(ExtLinear, 0, []byte{byte(w.upper >> 8), byte(w.upper)})
+		}
+		n := w.RecLen
+		if n <= 0 || n > 0xFF {
+			n = 16
+		}
+		if n > len(data) {
+			n = len(data)
+		}
+		if rest := 0x10000 - addr&0xFFFF; n > rest {
+			n = rest
+		}
+		w.record(Data, addr, data[:n])
+		addr += n
+		data = data[n:]
+	}
+	return w.err
+}
+
+// Write 16-bit words, low byte first, starting at byte address addr
+func (w *Writer) WriteWords(addr int, words []int) error {
+	data := make([]byte, 0, 2*len(words))
+	for _, v := range words {
+		data = append(data, byte(v), byte(v>>8))
+	}
+	return w.Write(addr, data)
+}
+
+// Put down the end of file record
+func (w *Writer) Close() error {
+	w.record(EOF, 0, nil)
+	return w.err
+}
+
+// Record as read, Addr includes the upper address bits in effect
+type Record struct {
+	Type int
+	Addr int
+	Data []byte
+}
+
+// Reader gets records from a HEX file, checking their syntax and checksums
+type Reader struct {
+	sc    *bufio.Scanner
+	line  int
+	upper int // upper address bits in effect
+	done  bool
+}
+
+func NewReader(r io.Reader) *Reader {
+	return &Reader{sc: bufio.NewScanner(r)}
+}
+
+func (r *Reader) errorf(format string, args ...interface{}) error {
+	return fmt.Errorf("line %d: %s", r.line, fmt.Sprintf(format, args...))
+}
+
+// Next record, io.EOF after the end of file record
+// Blank lines are skipped
+func (r *Reader) Next() (*Record, error) {
+	var text string
+
+	if r.done {
+		return nil, io.EOF
+	}
+	for text == "" {
+		if !r.sc.Scan() {
+			if err := r.sc.Err(); err != nil {
+				return nil, err
+			}
+			return nil, r.errorf("end of file record missing")
+		}
+		r.line += 1
+		text = strings.TrimSpace(r.sc.Text())
+	}
+	if text[0] != ':' || len(text) < 11 || len(text)%2 == 0 {
+		return nil, r.errorf("not a HEX record")
+	}
+	b := make([]byte, 0, len(text)/2)
+	sum := 0
+	for i := 1; i < len(text); i += 2 {
+		v, err := strconv.ParseUint(text[i:i+2], 16, 8)
+		if err != nil {
+			return nil, r.errorf("bad hex digits %s", text[i:i+2])
+		}
+		b = append(b, byte(v))
+		sum += int(v)
+	}
+	if int(b[0]) != len(b)-5 {
+		return nil, r.errorf("length %d does not match %d data bytes", b[0], len(b)-5)
+	}
+	if sum&0xFF != 0 {
+		return nil, r.errorf("bad checksum")
+	}
+
+	rec := &Record{Type: int(b[3]), Addr: r.upper<<16 | int(b[1])<<8 | int(b[2]), Data: b[4 : len(b)-1]}
+	switch rec.Type {
+	case EOF:
+		r.done = true
+	case ExtLinear:
+		if len(rec.Data) != 2 {
+			return nil, r.errorf("bad extended address record")
+		}
+		r.upper = int(rec.Data[0])<<8 | int(rec.Data[1])
+	case ExtSegment:
+		if len(rec.Data) != 2 {
+			return nil, r.errorf("bad extended address record")
+		}
+		// Segment base, as far as it fits a linear address
+		r.upper = (int(rec.Data[0])<<8 | int(rec.Data[1])) >> 12
+	}
+	return rec, nil
+}
+
+// Image holds memory contents by byte address
+type Image map[int]byte
+
+// Read a HEX file into an image
+func ReadImage(rd io.Reader) (Image, error) {
+	m := make(Image)
+	r := NewReader(rd)
+	for {
+		rec, err := r.Next()
+		if err == io.EOF {
+			return m, nil
+		} else if err != nil {
+			return nil, err
+		}
+		if rec.Type == Data {
+			for i, d := range rec.Data {
+				m[rec.Addr+i] = d
+			}
+		}
+	}
+}
+
+// Word at byte address a, low byte first, and whether it is present
+func (m Image) Word(a int) (int, bool) {
+	lo, ok1 := m[a]
+	hi, ok2 := m[a+1]
+	return int(hi)<<8 | int(lo), ok1 || ok2
+}
+
+// Words from byte address start up to end (exclusive), missing words are
+// fill
+func (m Image) Words(start int, end int, fill int) []int {
+	var words []int
+
+	for a := start; a < end; a += 2 {
+		w, ok := m.Word(a)
+		if !ok {
+			w = fill
+		}
+		words = append(words, w)
+	}
+	return words
+}
+
+// Highest byte address present below end, -1 if there is none
+func (m Image) Last(end int) int {
+	last := -1
+	for a := range m {
+		if a < end && a > last {
+			last = a
+		}
+	}
+	return last
+}
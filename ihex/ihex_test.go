@@ -0,0 +1,112 @@
+package ihex
+
+import (
+	"bytes"
+	"io"
+	"strings"
+	"testing"
+)
+
+func TestWriter(t *testing.T) {
+	var b bytes.Buffer
+	w := NewWriter(&b)
+	w.WriteWords(0, []int{0x2808, 0x3FFF})
+	w.WriteWords(2*0x2007, []int{0x3FFF})
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	want := ":0400000008 28FF3F8E\n:02400E00FF3F72\n:00000001FF\n"
+	if got := b.String(); got != strings.ReplaceAll(want, " ", "") {
+		t.Errorf("got\n%swant\n%s", got, want)
+	}
+}
+
+func TestWriterSplit(t *testing.T) {
+	var b bytes.Buffer
+	w := NewWriter(&b)
+	w.RecLen = 4
+	w.Write(0xFFFA, []byte{1, 2, 3, 4, 5, 6, 7, 8})
+	w.Close()
+	want := []string{
+		":04FFFA0001020304F9",
+		":02FFFE000506F6",
+		":020000040001F9",
+		":020000000708EF",
+		":00000001FF",
+	}
+	if got := strings.Fields(b.String()); strings.Join(got, " ") != strings.Join(want, " ") {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
+
+func TestRoundTrip(t *testing.T) {
+	code := make([]int, 100)
+	for i := range code {
+		code[i] = i * 0x95 % 0x4000
+	}
+	var b bytes.Buffer
+	w := NewWriter(&b)
+	w.RecLen = 7
+	w.WriteWords(0, code)
+	w.WriteWords(0x1FFFC, []int{0x1234, 0x5678, 0x9ABC})
+	w.Close()
+
+	m, err := ReadImage(&b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, v := range m.Words(0, 2*len(code), -1) {
+		if v != code[i] {
+			t.Errorf("word %#x = %#.4x, want %#.4x", i, v, code[i])
+		}
+	}
+	if v, ok := m.Word(0x20000); !ok || v != 0x9ABC {
+		t.Errorf("word at 0x20000 = %#.4x %v, want 0x9abc", v, ok)
+	}
+	if _, ok := m.Word(2 * len(code)); ok {
+		t.Errorf("word after the code present")
+	}
+	if last := m.Last(0x10000); last != 2*len(code)-1 {
+		t.Errorf("last byte below 0x10000 at %#x, want %#x", last, 2*len(code)-1)
+	}
+}
+
+func TestReaderErrors(t *testing.T) {
+	for _, tt := range []struct {
+		name, text, err string
+	}{
+		{"checksum", ":0400000008 28FF3F8F\n:00000001FF\n", "line 1: bad checksum"},
+		{"length", ":0500000008 28FF3F8D\n:00000001FF\n", "line 1: length 5 does not match 4 data bytes"},
+		{"colon", "0400000008 28FF3F8E\n", "line 1: not a HEX record"},
+		{"short", ":000000\n", "line 1: not a HEX record"},
+		{"digits", ":0400000008 28FG3F8E\n", "line 1: bad hex digits FG"},
+		{"end missing", ":0400000008 28FF3F8E\n\n", "line 2: end of file record missing"},
+		{"extended", ":0100000400FB\n", "line 1: bad extended address record"},
+	} {
+		_, err := ReadImage(strings.NewReader(strings.ReplaceAll(tt.text, " ", "")))
+		if err == nil || err.Error() != tt.err {
+			t.Errorf("%s: error %v, want %s", tt.name, err, tt.err)
+		}
+	}
+}
+
+func TestReaderRecords(t *testing.T) {
+	text := "\n:020000021000EC\n:0100100042AD\n:00000001FF\n:0100000000FF\n"
+	r := NewReader(strings.NewReader(text))
+	var recs []*Record
+	for {
+		rec, err := r.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			t.Fatal(err)
+		}
+		recs = append(recs, rec)
+	}
+	if len(recs) != 3 {
+		t.Fatalf("%d records, want 3, none after the end of file record", len(recs))
+	}
+	if rec := recs[1]; rec.Type != Data || rec.Addr != 0x10010 || !bytes.Equal(rec.Data, []byte{0x42}) {
+		t.Errorf("data record %+v, want 0x42 at 0x10010", rec)
+	}
+}
@@ -0,0 +1,72 @@
+/*
+piclc asm: assemble source files into HEX files
+The registers of the device are predeclared, the configuration word goes
+to its address
+*/
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"picl-go/asm"
+	"picl-go/ihex"
+	"sort"
+	"strings"
+)
+
+func assemble(args []string) {
+	fs := flag.NewFlagSet("asm", flag.ExitOnError)
+	fs.Parse(args)
+	if fs.NArg() < 1 {
+		usage()
+		return
+	}
+
+	for _, filename := range fs.Args() {
+		src, err := os.ReadFile(filename)
+		if err != nil {
+			fmt.Println(err)
+			continue
+		}
+		fmt.Printf("Assembling: %s for %s\n", filename, dev.Name)
+		a := asm.New()
+		for _, r := range dev.SFRs {
+			a.Symbols[r.Name] = r.Addr
+		}
+		a.ConfigAddr = dev.Config.Addr
+		segs, errs := a.Assemble(src, 0)
+		for _, e := range errs {
+			fmt.Fprintf(os.Stderr, "%s:%d:1: error: %s\n", filename, e.Line, e.Msg)
+		}
+		fmt.Printf("Errors: %d\n", len(errs))
+		if len(errs) > 0 {
+			continue
+		}
+
+		froot := strings.TrimSuffix(filepath.Base(filename), filepath.Ext(filename))
+		if err = asmHex(froot+".hex", segs); err != nil {
+			fmt.Println(err)
+		}
+	}
+}
+
+// Output the segments as a HEX file, in order of address
+func asmHex(filename string, segs []asm.Segment) error {
+	sort.SliceStable(segs, func(i, j int) bool { return segs[i].Addr < segs[j].Addr })
+	f, err := os.Create(filename)
+	if err != nil {
+		return err
+	}
+	w := ihex.NewWriter(f)
+	for _, s := range segs {
+		w.WriteWords(2*s.Addr, s.Words)
+	}
+	if err = w.Close(); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
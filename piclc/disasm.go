@@ -0,0 +1,31 @@
+/*
+piclc disasm: disassemble a HEX file, eg from another tool or an older
+compiler version
+*/
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+)
+
+func disassemble(args []string) {
+	fs := flag.NewFlagSet("disasm", flag.ExitOnError)
+	fs.Parse(args)
+	if fs.NArg() < 1 {
+		usage()
+		return
+	}
+
+	for _, filename := range fs.Args() {
+		res, err := load(filename)
+		if err != nil {
+			fmt.Println(err)
+			continue
+		}
+		fmt.Printf("\n")
+		res.Disassemble(os.Stdout, dev)
+	}
+}
@@ -10,76 +10,164 @@ C:\Data\Personal\go\bin> piclc file.pcl
 package main
 
 import (
-	"bufio"
 	"flag"
 	"fmt"
-   "io"
-   "path/filepath"
+	"io"
 	"os"
+	"path/filepath"
 	"picl-go/PICL"
+	"picl-go/ihex"
+	"strings"
 )
 
 const Ver = "PICL compiler v1.0-beta-2"
 
 var (
-   dump bool
-   list bool
+	dump   bool
+	list   bool
+	maps   bool
+	asmOut bool
+	checks bool
+	device string
+	dev    *PICL.Device
 )
 
 func init() {
 	flag.BoolVar(&dump, "d", false, "Dump program memory image to console")
-   flag.BoolVar(&list, "l", false, "Generate listing file")
+	flag.BoolVar(&list, "l", false, "Generate listing file")
+	flag.BoolVar(&asmOut, "S", false, "Generate MPASM/gpasm assembly file (.asm)")
+	flag.BoolVar(&maps, "m", false, "Generate map file (.map) and JSON symbol file (.json)")
+	flag.BoolVar(&checks, "b", false, "Check array bounds at run time")
+	flag.StringVar(&device, "device", "16F688", "Target device: "+strings.Join(PICL.Devices(), ", ")+" or a .dev file")
 }
 
-// Output an Intel HEX-record file
-// format has 6 fields, all ASCII characters (2 chars per byte):
-// : ll aaaa tt dd dd dd .... cc
-// ll = 1 byte length, count only data bytes
-// aaaa = 2 byte address
-// tt = 1 byte type field (00 for normal, 01 for last record)
-// dd = data bytes
-// cc = checksum
-func hexfile(f io.Writer) {
-   var byteH, byteL, checksum int
-   var recs, lastrec, addr int
-   
-   recs = PICL.Pc / 8
-   lastrec = PICL.Pc % 8
-   
-   // Full records of 16 bytes (note each instruction is 2 bytes!)
-   for i := 0; i < recs; i += 1 {
-      addr = i*16
-      fmt.Fprintf(f, ":10%.4X00", addr)
-      checksum = 0x10 + ((addr & 0xFF00) >> 8) + (addr & 0x00FF)
-      for j := 0; j < 8; j += 1 {
-         byteH = (PICL.Code[i*8+j] & 0xFF00) >> 8
-         byteL = PICL.Code[i*8+j] & 0x00FF
-         // Remember to byte swap!
-         fmt.Fprintf(f, "%.2X%.2X", byteL, byteH)
-         checksum = checksum + byteH + byteL
-      }
-      fmt.Fprintf(f, "%.2X\n", (^(checksum & 0x00FF) + 1) & 0x00FF)
-   }
-   
-   // The last, partial record
-   if lastrec > 0 {
-      here := recs * 8
-      addr = here * 2
-      fmt.Fprintf(f, ":%.2X%.4X00", lastrec*2, addr)
-      checksum = lastrec*2 + ((addr & 0xFF00) >> 8) + (addr & 0x00FF)
-      for i := here; i < PICL.Pc; i+= 1 {
-         byteH = (PICL.Code[i] & 0xFF00) >> 8
-         byteL = PICL.Code[i] & 0x00FF
-         // Remember to byte swap!
-         fmt.Fprintf(f, "%.2X%.2X", byteL, byteH)
-         checksum = checksum + byteH + byteL
-      }
-      fmt.Fprintf(f, "%.2X\n", (^(checksum & 0x00FF) + 1) & 0x00FF)
-   }
-   
-   // Terminating record
-   fmt.Fprintf(f, ":00000001FF\n")
-   
+// Output an Intel HEX file, program words at twice their address
+// The configuration word and the EEPROM contents go at their addresses
+func hexfile(filename string, res *PICL.Result) error {
+	f, err := os.Create(filename)
+	if err != nil {
+		return err
+	}
+	w := ihex.NewWriter(f)
+	w.WriteWords(0, res.Code)
+	if res.Config >= 0 {
+		w.WriteWords(2*dev.Config.Addr, []int{res.Config})
+	}
+	if len(res.EEPROM) > 0 {
+		w.WriteWords(2*dev.EEPROM.Addr, res.EEPROM)
+	}
+	if err = w.Close(); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// Output the listing file
+func listing(filename string, res *PICL.Result) error {
+	f, err := os.Create(filename)
+	if err != nil {
+		return err
+	}
+	res.Decode(f)
+	return f.Close()
+}
+
+// Output the assembly file
+func assembly(filename string, res *PICL.Result) error {
+	f, err := os.Create(filename)
+	if err != nil {
+		return err
+	}
+	res.Assembly(f, dev)
+	return f.Close()
+}
+
+// Output the map file and the JSON symbol file
+func mapfiles(froot string, res *PICL.Result) error {
+	f, err := os.Create(froot + ".map")
+	if err != nil {
+		return err
+	}
+	res.MapFile(f)
+	if err = f.Close(); err != nil {
+		return err
+	}
+	if f, err = os.Create(froot + ".json"); err != nil {
+		return err
+	}
+	if err = res.WriteJSON(f, dev); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// Print diagnostics in the usual compiler format, file:line:col: severity: message
+func diagnostics(w io.Writer, filename string, diags []PICL.Diagnostic) {
+	for _, d := range diags {
+		fmt.Fprintf(w, "%s:%d:%d: %s: %s\n", filename, d.Pos.Line, d.Pos.Col, d.Severity, d.Message)
+	}
+}
+
+// Compile a source file, printing diagnostics
+// The result is nil if the source could not be read
+func compile(filename string) (*PICL.Result, error) {
+	if filepath.Ext(filename) != ".pcl" {
+		return nil, fmt.Errorf("Source file must end in .pcl")
+	}
+	file, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	fmt.Printf("Compiling: %s for %s\n", filename, dev.Name)
+	c := PICL.NewCompiler(dev)
+	c.IndexChecks = checks
+	res, err := c.Compile(file)
+	diagnostics(os.Stderr, filename, res.Diagnostics)
+	fmt.Printf("Errors: %d\n", res.Errors)
+	fmt.Printf("%s\n", res.Usage)
+	return res, err
+}
+
+// Load the program, configuration word and EEPROM contents of a HEX file
+// Words not in the file read as erased
+func load(filename string) (*PICL.Result, error) {
+	file, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	m, err := ihex.ReadImage(file)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", filename, err)
+	}
+	fmt.Printf("Loading: %s for %s\n", filename, dev.Name)
+	res := &PICL.Result{Config: -1}
+	if last := m.Last(2 * dev.ProgSize); last >= 0 {
+		res.Code = m.Words(0, last+1, 0x3FFF)
+	}
+	if w, ok := m.Word(2 * dev.Config.Addr); ok && dev.Config.Addr > 0 {
+		res.Config = w & 0x3FFF
+	}
+	ee := 2 * dev.EEPROM.Addr
+	if last := m.Last(ee + 2*dev.EEPROM.Size); last >= ee && dev.EEPROM.Size > 0 {
+		for _, w := range m.Words(ee, last+1, 0xFF) {
+			res.EEPROM = append(res.EEPROM, w&0xFF)
+		}
+	}
+	return res, nil
+}
+
+func usage() {
+	fmt.Printf("Usage: piclc <flags> sourcefile.pcl\n")
+	fmt.Printf("       piclc sim <flags> sourcefile.pcl|file.hex\n")
+	fmt.Printf("       piclc disasm file.hex ...\n")
+	fmt.Printf("       piclc asm file.asm ...\n")
+	flag.PrintDefaults()
 }
 
 func main() {
@@ -90,47 +178,67 @@ func main() {
 	flag.Parse()
 	// Exit on error
 	if !(len(flag.Args()) > 0) {
-		fmt.Printf("Usage: piclc <flags> sourcefile.pcl\n")
-		flag.PrintDefaults()
+		usage()
+		return
+	}
+
+	// Target device
+	var err error
+	if dev, err = PICL.LoadDevice(device); err != nil {
+		fmt.Println(err)
+		return
+	}
+
+	// Subcommands
+	switch flag.Arg(0) {
+	case "sim":
+		simulate(flag.Args()[1:])
+		return
+	case "disasm":
+		disassemble(flag.Args()[1:])
+		return
+	case "asm":
+		assemble(flag.Args()[1:])
 		return
 	}
 
-	// Open source file
+	// Compile
 	filename := flag.Arg(0)
-   if filepath.Ext(filename) != ".pcl" {
-      fmt.Printf("Source file must end in .pcl\n")
-      return
-   }
-	file, err := os.Open(filename)
-	
-   // Compile
-   if err != nil {
+	res, err := compile(filename)
+	if res == nil {
 		fmt.Println(err)
 		return
-	} else {
-		fmt.Printf("Compiling: %s\n", filename)
-		PICL.Compile(bufio.NewReader(file))
-	}
-   
-   // Handle options
-   if dump {
-		for addr := 0; addr < PICL.Pc; addr += 1 {
-			fmt.Printf("%#.3x %#.4x\n", addr, PICL.Code[addr])
+	}
+
+	// Handle options
+	if dump {
+		for addr := 0; addr < len(res.Code); addr += 1 {
+			fmt.Printf("%#.3x %#.4x\n", addr, res.Code[addr])
 		}
 	}
-   
-   // Output on successful compile
-   if !PICL.Err {
-      fname := filepath.Base(filename)
-      froot := fname[:len(fname)-4]
-      h, _ := os.Create(froot+".hex")
-      hexfile(h)
-      h.Close()
-      if list {
-         l, _ := os.Create(froot+".lst")
-         PICL.Decode(l)
-         l.Close()
-      }
-   }
-   
+
+	// Output on successful compile
+	if err == nil {
+		fname := filepath.Base(filename)
+		froot := fname[:len(fname)-4]
+		if err = hexfile(froot+".hex", res); err != nil {
+			fmt.Println(err)
+		}
+		if list {
+			if err = listing(froot+".lst", res); err != nil {
+				fmt.Println(err)
+			}
+		}
+		if maps {
+			if err = mapfiles(froot, res); err != nil {
+				fmt.Println(err)
+			}
+		}
+		if asmOut {
+			if err = assembly(froot+".asm", res); err != nil {
+				fmt.Println(err)
+			}
+		}
+	}
+
 }
@@ -0,0 +1,129 @@
+/*
+piclc sim: compile a module and run it on the instruction set simulator
+A .hex file is loaded instead, there are no variables to show then
+*/
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"path/filepath"
+	"picl-go/PICL"
+	"picl-go/PICS"
+	"picl-go/sim"
+)
+
+func simulate(args []string) {
+	fs := flag.NewFlagSet("sim", flag.ExitOnError)
+	cycles := fs.Int("c", 1000000, "Maximum number of instruction cycles to run")
+	period := fs.Int("i", 0, "Request an interrupt every `n` cycles, 0 for none")
+	fs.Parse(args)
+	if fs.NArg() < 1 {
+		usage()
+		fs.PrintDefaults()
+		return
+	}
+
+	var res *PICL.Result
+	var err error
+	if filepath.Ext(fs.Arg(0)) == ".hex" {
+		res, err = load(fs.Arg(0))
+	} else {
+		res, err = compile(fs.Arg(0))
+	}
+	if err != nil {
+		if res == nil {
+			fmt.Println(err)
+		}
+		return
+	}
+
+	// Run
+	shared := make([]sim.Range, len(dev.Shared))
+	for i, r := range dev.Shared {
+		shared[i] = sim.Range(r)
+	}
+	cpu := sim.New(res.Code, dev.Banks(), shared)
+	cpu.EE = eeprom(res.EEPROM)
+	if *period > 0 {
+		for cpu.Cycles < *cycles && !cpu.Halted() {
+			cpu.Run(*period)
+			if !cpu.Halted() {
+				cpu.Interrupt()
+			}
+		}
+	} else {
+		cpu.Run(*cycles)
+	}
+	switch {
+	case cpu.Asleep:
+		fmt.Printf("\nAsleep after %d cycles\n", cpu.Cycles)
+	case cpu.Halted():
+		fmt.Printf("\nEnd of program after %d cycles\n", cpu.Cycles)
+	default:
+		fmt.Printf("\nStopped after %d cycles\n", cpu.Cycles)
+	}
+	fmt.Printf("PC %#.3x W %#.2x STATUS %#.2x\n", cpu.PC, cpu.W, cpu.Reg(sim.STATUS))
+
+	// Module variables in order of declaration
+	if len(res.Symbols) > 0 {
+		fmt.Printf("\nVariables:\n")
+	}
+	for i := len(res.Symbols) - 1; i >= 0; i -= 1 {
+		obj := res.Symbols[i]
+		if obj.Form == PICL.Variable && obj.Typ == PICS.Word_t {
+			v := cpu.Reg(obj.Addr) | cpu.Reg(obj.Addr+1)<<8
+			fmt.Printf("%#.2x %-16s %5d %#.4x\n", obj.Addr, obj.Name, v, v)
+		} else if obj.Form == PICL.Variable && obj.Len > 0 {
+			fmt.Printf("%#.2x %-16s", obj.Addr, obj.Name)
+			for i := 0; i < obj.Len; i += 1 {
+				fmt.Printf(" %d", cpu.Reg(obj.Addr+i))
+			}
+			fmt.Printf("\n")
+		} else if obj.Form == PICL.Variable {
+			fmt.Printf("%#.2x %-16s %3d %#.2x\n", obj.Addr, obj.Name, cpu.Reg(obj.Addr), cpu.Reg(obj.Addr))
+		}
+	}
+
+	// Data EEPROM up to the last byte programmed
+	if cpu.EE != nil {
+		n := len(cpu.EE.Data)
+		for n > 0 && cpu.EE.Data[n-1] == 0xFF {
+			n -= 1
+		}
+		if n > 0 {
+			fmt.Printf("\nEEPROM:")
+			for i, b := range cpu.EE.Data[:n] {
+				if i%8 == 0 {
+					fmt.Printf("\n%#.2x ", i)
+				}
+				fmt.Printf(" %#.2x", b)
+			}
+			fmt.Printf("\n")
+		}
+	}
+}
+
+// Data EEPROM of the device, erased and loaded with data
+// nil if the device has none
+func eeprom(data []int) *sim.EEPROM {
+	reg := make(map[string]int)
+	for _, r := range dev.SFRs {
+		reg[r.Name] = r.Addr
+	}
+	if _, ok := reg["EEDAT"]; !ok {
+		reg["EEDAT"] = reg["EEDATA"]
+	}
+	if dev.EEPROM.Size == 0 || reg["EEDAT"] == 0 || reg["EEADR"] == 0 || reg["EECON1"] == 0 {
+		return nil
+	}
+
+	ee := &sim.EEPROM{Dat: reg["EEDAT"], Adr: reg["EEADR"], Con1: reg["EECON1"]}
+	ee.Data = make([]int, dev.EEPROM.Size)
+	for i := range ee.Data {
+		ee.Data[i] = 0xFF
+	}
+	copy(ee.Data, data)
+	return ee
+}
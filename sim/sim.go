@@ -0,0 +1,471 @@
+/*
+sim.go: Instruction set simulator for the PIC16 mid-range core
+Notes:
+1. Executes 14-bit program images as produced by PICL.Compile
+2. All 35 instructions, W, STATUS flags Z/DC/C, 8-level hardware stack,
+   2 or 4 banks of file registers, PCLATH and indirect addressing via FSR/INDF
+3. One cycle per instruction, two for branches, calls, returns, skips taken
+   and writes to PCL
+4. Peripherals are not simulated: SFRs other than the core registers
+   behave like plain RAM. Interrupt requests come from the caller, see
+   Interrupt. The data EEPROM is simulated if given, see EEPROM
+5. INDF, PCL, STATUS, FSR, PCLATH and INTCON are common to all banks,
+   besides the shared ranges of the device, eg 0x70-0x7F on the 16F688
+6. With 2 banks, RP1 and IRP are ignored, as on the 16F84A
+*/
+
+package sim
+
+// Core register addresses
+const (
+	INDF   = 0x00
+	PCL    = 0x02
+	STATUS = 0x03
+	FSR    = 0x04
+	PCLATH = 0x0A
+	INTCON = 0x0B
+)
+
+// STATUS bits
+const (
+	C   = 0
+	DC  = 1
+	Z   = 2
+	PD  = 3
+	TO  = 4
+	RP0 = 5
+	RP1 = 6
+	IRP = 7
+)
+
+const (
+	ProgSize  = 0x2000 // 13-bit program counter
+	RAMSize   = 0x200  // 4 banks of 128 registers
+	StackSize = 8
+	Vector    = 0x004  // interrupt vector
+	erased    = 0x3FFF // unprogrammed program memory word
+)
+
+// EEPROM is the data EEPROM with the addresses of its registers
+// Setting RD or WR in EECON1 reads or writes the byte at once, the unlock
+// sequence through EECON2 is not checked
+type EEPROM struct {
+	Data           []int
+	Dat, Adr, Con1 int
+}
+
+// EECON1 bits
+const (
+	RD   = 0
+	WR   = 1
+	WREN = 2
+)
+
+// Range of register addresses common to all banks, offsets within a bank
+type Range struct {
+	Lo, Hi int
+}
+
+// CPU is the state of one simulated microcontroller
+type CPU struct {
+	prog   [ProgSize]int
+	ram    [RAMSize]int
+	stack  [StackSize]int
+	sp     int
+	end    int     // first address after the loaded image
+	banks  int     // 2 or 4
+	shared []Range // besides the core registers
+	W      int
+	PC     int
+	Cycles int
+	Asleep bool
+	EE     *EEPROM // nil if there is none
+}
+
+// Set up a CPU with code loaded from address 0, and reset it
+// The device has the given number of register banks, and the shared
+// registers are common to all of them
+func New(code []int, banks int, shared []Range) *CPU {
+	c := new(CPU)
+	c.banks = banks
+	c.shared = shared
+	for i := range c.prog {
+		c.prog[i] = erased
+	}
+	copy(c.prog[:], code)
+	c.end = len(code)
+	c.Reset()
+	return c
+}
+
+// Power-on reset
+func (c *CPU) Reset() {
+	c.ram = [RAMSize]int{}
+	c.ram[STATUS] = 1<<TO | 1<<PD
+	c.sp = 0
+	c.W = 0
+	c.PC = 0
+	c.Cycles = 0
+	c.Asleep = false
+}
+
+// Has the CPU gone to sleep or run past the end of the loaded image?
+// PICL modules simply end after their body, so the latter is the usual way
+// for a program to finish
+func (c *CPU) Halted() bool {
+	return c.Asleep || c.PC >= c.end
+}
+
+// Read a file register, addr is a full 9-bit address (bank*0x80 + offset)
+func (c *CPU) Reg(addr int) int {
+	return c.read(addr % RAMSize)
+}
+
+// Write a file register, addr is a full 9-bit address
+func (c *CPU) SetReg(addr int, v int) {
+	c.write(addr%RAMSize, v)
+}
+
+// Hardware stack contents, oldest entry first
+func (c *CPU) Stack() []int {
+	s := make([]int, 0, StackSize)
+	for i := 0; i < StackSize; i += 1 {
+		s = append(s, c.stack[(c.sp+i)%StackSize])
+	}
+	return s
+}
+
+// Run until at least n cycles have been executed or the CPU halts
+// Returns the number of cycles executed
+func (c *CPU) Run(n int) int {
+	start := c.Cycles
+	for c.Cycles-start < n && !c.Halted() {
+		c.Step()
+	}
+	return c.Cycles - start
+}
+
+// Interrupt request, as raised by a peripheral
+// If GIE is set, it is cleared, the PC pushed and execution continues at
+// the interrupt vector. Returns whether the interrupt was taken
+func (c *CPU) Interrupt() bool {
+	if c.ram[INTCON]&0x80 == 0 {
+		return false
+	}
+	c.ram[INTCON] &^= 0x80
+	c.push(c.PC)
+	c.PC = Vector
+	c.Asleep = false
+	return true
+}
+
+// Fold mirrored registers onto their bank 0 address
+func (c *CPU) phys(a int) int {
+	f := a % 0x80
+	switch f {
+	case INDF, PCL, STATUS, FSR, PCLATH, INTCON:
+		return f
+	}
+	for _, r := range c.shared {
+		if f >= r.Lo && f <= r.Hi {
+			return f
+		}
+	}
+	return a
+}
+
+// Full address of file register f, taking bank bits and INDF into account
+func (c *CPU) addr(f int) int {
+	if f == INDF && c.banks > 2 {
+		return (c.ram[STATUS]>>IRP&1)<<8 | c.ram[FSR]
+	} else if f == INDF {
+		return c.ram[FSR]
+	}
+	return (c.ram[STATUS]>>RP0&3)%c.banks<<7 | f
+}
+
+func (c *CPU) read(a int) int {
+	switch p := c.phys(a); p {
+	case INDF:
+		// INDF addressing itself reads as 0
+		return 0
+	case PCL:
+		return c.PC & 0xFF
+	default:
+		return c.ram[p]
+	}
+}
+
+func (c *CPU) write(a int, v int) {
+	v &= 0xFF
+	switch p := c.phys(a); p {
+	case INDF:
+	case PCL:
+		// Computed jump
+		c.PC = (c.ram[PCLATH]&0x1F)<<8 | v
+		c.Cycles += 1
+	case STATUS:
+		// TO and PD are read only
+		c.ram[STATUS] = v&^(1<<TO|1<<PD) | c.ram[STATUS]&(1<<TO|1<<PD)
+	default:
+		c.ram[p] = v
+		if c.EE != nil && p == c.EE.Con1 {
+			c.eeprom()
+		}
+	}
+}
+
+// Carry out an EEPROM read or write started through EECON1
+func (c *CPU) eeprom() {
+	con := c.ram[c.EE.Con1]
+	a := c.ram[c.EE.Adr] % len(c.EE.Data)
+	if con>>RD&1 != 0 {
+		c.ram[c.EE.Dat] = c.EE.Data[a]
+	}
+	if con>>WR&1 != 0 && con>>WREN&1 != 0 {
+		c.EE.Data[a] = c.ram[c.EE.Dat]
+	}
+	c.ram[c.EE.Con1] = con &^ (1<<RD | 1<<WR)
+}
+
+func (c *CPU) flag(bit int, set bool) {
+	if set {
+		c.ram[STATUS] |= 1 << bit
+	} else {
+		c.ram[STATUS] &^= 1 << bit
+	}
+}
+
+func (c *CPU) carry() int {
+	return c.ram[STATUS] >> C & 1
+}
+
+func (c *CPU) push(a int) {
+	c.stack[c.sp] = a
+	c.sp = (c.sp + 1) % StackSize
+}
+
+func (c *CPU) pop() int {
+	c.sp = (c.sp + StackSize - 1) % StackSize
+	return c.stack[c.sp]
+}
+
+// Put down the result of a byte-oriented operation, d selects F or W
+func (c *CPU) store(a int, d bool, v int) {
+	if d {
+		c.write(a, v)
+	} else {
+		c.W = v & 0xFF
+	}
+}
+
+// Execute one instruction, returns the number of cycles it took
+func (c *CPU) Step() int {
+	start := c.Cycles
+	c.Cycles += 1
+	if c.Asleep {
+		return 1
+	}
+	op := c.prog[c.PC] & 0x3FFF
+	c.PC = (c.PC + 1) % ProgSize
+
+	switch op >> 12 {
+	case 0:
+		c.byteOp(op)
+	case 1:
+		c.bitOp(op)
+	case 2:
+		// CALL, GOTO
+		if op&0x800 == 0 {
+			c.push(c.PC)
+		}
+		c.PC = (c.ram[PCLATH]&0x18)<<8 | op&0x7FF
+		c.Cycles += 1
+	case 3:
+		c.literalOp(op)
+	}
+	return c.Cycles - start
+}
+
+func (c *CPU) byteOp(op int) {
+	var r int
+
+	d := op&0x80 != 0
+	a := c.addr(op & 0x7F)
+	switch op >> 8 {
+	case 0x00:
+		if d {
+			// MOVWF
+			c.write(a, c.W)
+		} else if op == 0x0008 {
+			// RETURN
+			c.PC = c.pop()
+			c.Cycles += 1
+		} else if op == 0x0009 {
+			// RETFIE
+			c.PC = c.pop()
+			c.ram[INTCON] |= 0x80
+			c.Cycles += 1
+		} else if op == 0x0063 {
+			// SLEEP
+			c.ram[STATUS] = c.ram[STATUS]&^(1<<PD) | 1<<TO
+			c.Asleep = true
+		} else if op == 0x0064 {
+			// CLRWDT
+			c.ram[STATUS] |= 1<<TO | 1<<PD
+		}
+		// otherwise NOP
+	case 0x01:
+		// CLRF, CLRW
+		c.store(a, d, 0)
+		c.flag(Z, true)
+	case 0x02:
+		// SUBWF
+		f := c.read(a)
+		r = f - c.W
+		c.store(a, d, r)
+		c.flag(C, r >= 0)
+		c.flag(DC, f&0xF >= c.W&0xF)
+		c.flag(Z, r&0xFF == 0)
+	case 0x03:
+		// DECF
+		r = c.read(a) - 1
+		c.store(a, d, r)
+		c.flag(Z, r&0xFF == 0)
+	case 0x04:
+		// IORWF
+		r = c.read(a) | c.W
+		c.store(a, d, r)
+		c.flag(Z, r == 0)
+	case 0x05:
+		// ANDWF
+		r = c.read(a) & c.W
+		c.store(a, d, r)
+		c.flag(Z, r == 0)
+	case 0x06:
+		// XORWF
+		r = c.read(a) ^ c.W
+		c.store(a, d, r)
+		c.flag(Z, r == 0)
+	case 0x07:
+		// ADDWF
+		f := c.read(a)
+		r = f + c.W
+		c.store(a, d, r)
+		c.flag(C, r > 0xFF)
+		c.flag(DC, f&0xF+c.W&0xF > 0xF)
+		c.flag(Z, r&0xFF == 0)
+	case 0x08:
+		// MOVF
+		r = c.read(a)
+		c.store(a, d, r)
+		c.flag(Z, r == 0)
+	case 0x09:
+		// COMF
+		r = ^c.read(a) & 0xFF
+		c.store(a, d, r)
+		c.flag(Z, r == 0)
+	case 0x0A:
+		// INCF
+		r = c.read(a) + 1
+		c.store(a, d, r)
+		c.flag(Z, r&0xFF == 0)
+	case 0x0B:
+		// DECFSZ
+		r = (c.read(a) - 1) & 0xFF
+		c.store(a, d, r)
+		if r == 0 {
+			c.skip()
+		}
+	case 0x0C:
+		// RRF
+		f := c.read(a)
+		c.store(a, d, f>>1|c.carry()<<7)
+		c.flag(C, f&1 != 0)
+	case 0x0D:
+		// RLF
+		f := c.read(a)
+		c.store(a, d, f<<1|c.carry())
+		c.flag(C, f&0x80 != 0)
+	case 0x0E:
+		// SWAPF
+		f := c.read(a)
+		c.store(a, d, f>>4|f<<4)
+	case 0x0F:
+		// INCFSZ
+		r = (c.read(a) + 1) & 0xFF
+		c.store(a, d, r)
+		if r == 0 {
+			c.skip()
+		}
+	}
+}
+
+// BCF, BSF, BTFSC, BTFSS
+func (c *CPU) bitOp(op int) {
+	a := c.addr(op & 0x7F)
+	mask := 1 << (op >> 7 & 7)
+	switch op >> 10 & 3 {
+	case 0:
+		c.write(a, c.read(a)&^mask)
+	case 1:
+		c.write(a, c.read(a)|mask)
+	case 2:
+		if c.read(a)&mask == 0 {
+			c.skip()
+		}
+	case 3:
+		if c.read(a)&mask != 0 {
+			c.skip()
+		}
+	}
+}
+
+func (c *CPU) literalOp(op int) {
+	var r int
+
+	k := op & 0xFF
+	switch {
+	case op < 0x3400:
+		// MOVLW
+		c.W = k
+	case op < 0x3800:
+		// RETLW
+		c.W = k
+		c.PC = c.pop()
+		c.Cycles += 1
+	case op>>8 == 0x38:
+		// IORLW
+		c.W |= k
+		c.flag(Z, c.W == 0)
+	case op>>8 == 0x39:
+		// ANDLW
+		c.W &= k
+		c.flag(Z, c.W == 0)
+	case op>>8 == 0x3A:
+		// XORLW
+		c.W ^= k
+		c.flag(Z, c.W == 0)
+	case op>>9 == 0x1E:
+		// SUBLW
+		r = k - c.W
+		c.flag(C, r >= 0)
+		c.flag(DC, k&0xF >= c.W&0xF)
+		c.W = r & 0xFF
+		c.flag(Z, c.W == 0)
+	case op>>9 == 0x1F:
+		// ADDLW
+		r = k + c.W
+		c.flag(C, r > 0xFF)
+		c.flag(DC, k&0xF+c.W&0xF > 0xF)
+		c.W = r & 0xFF
+		c.flag(Z, c.W == 0)
+	}
+	// 0x3B00 is unused, executes as NOP
+}
+
+// Skip the next instruction, costs an extra cycle
+func (c *CPU) skip() {
+	c.PC = (c.PC + 1) % ProgSize
+	c.Cycles += 1
+}
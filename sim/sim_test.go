@@ -0,0 +1,146 @@
+package sim
+
+import "testing"
+
+// Flags of STATUS checked by the tests
+const flags = 1<<C | 1<<DC | 1<<Z
+
+// Registers common to all banks of the 16F688 and the 16F84A
+var (
+	f688 = []Range{{0x70, 0x7F}}
+	f84  = []Range{{0x0C, 0x4F}}
+)
+
+var instrTests = []struct {
+	name   string
+	code   []int
+	w      int
+	status int         // C, DC and Z after the program
+	regs   map[int]int // expected register contents
+}{
+	{"MOVLW", []int{0x3042}, 0x42, 0, nil},
+	{"ADDLW carry", []int{0x30FF, 0x3E01}, 0x00, 1<<C | 1<<DC | 1<<Z, nil},
+	{"ADDLW digit carry", []int{0x300F, 0x3E01}, 0x10, 1 << DC, nil},
+	{"SUBLW", []int{0x3003, 0x3C05}, 0x02, 1<<C | 1<<DC, nil},
+	{"SUBLW borrow", []int{0x3005, 0x3C03}, 0xFE, 0, nil},
+	{"SUBLW zero", []int{0x3005, 0x3C05}, 0x00, 1<<C | 1<<DC | 1<<Z, nil},
+	{"IORLW zero", []int{0x3000, 0x3800}, 0x00, 1 << Z, nil},
+	{"ANDLW", []int{0x30F0, 0x393C}, 0x30, 0, nil},
+	{"XORLW zero", []int{0x305A, 0x3A5A}, 0x00, 1 << Z, nil},
+	{"MOVWF MOVF", []int{0x3000, 0x00A0, 0x0820}, 0x00, 1 << Z, map[int]int{0x20: 0}},
+	{"ADDWF F", []int{0x3080, 0x00A0, 0x07A0}, 0x80, 1<<C | 1<<Z, map[int]int{0x20: 0}},
+	{"SUBWF W", []int{0x3003, 0x00A0, 0x3005, 0x0220}, 0xFE, 0, nil},
+	{"INCF zero", []int{0x30FF, 0x00A0, 0x0AA0}, 0xFF, 1 << Z, map[int]int{0x20: 0}},
+	{"DECF", []int{0x3001, 0x00A0, 0x03A0}, 0x01, 1 << Z, map[int]int{0x20: 0}},
+	{"COMF", []int{0x300F, 0x00A0, 0x0920}, 0xF0, 0, nil},
+	{"CLRF", []int{0x3007, 0x00A0, 0x01A0}, 0x07, 1 << Z, map[int]int{0x20: 0}},
+	{"CLRW", []int{0x3007, 0x0103}, 0x00, 1 << Z, nil},
+	{"SWAPF", []int{0x30A5, 0x00A0, 0x0EA0}, 0xA5, 0, map[int]int{0x20: 0x5A}},
+	{"RLF", []int{0x3081, 0x00A0, 0x1003, 0x0DA0}, 0x81, 1 << C, map[int]int{0x20: 0x02}},
+	{"RRF", []int{0x3001, 0x00A0, 0x1403, 0x0CA0}, 0x01, 1 << C, map[int]int{0x20: 0x80}},
+	{"DECFSZ", []int{0x3002, 0x00A0, 0x0BA0, 0x2802, 0x3011}, 0x11, 0, map[int]int{0x20: 0}},
+	{"INCFSZ", []int{0x30FE, 0x00A0, 0x0FA0, 0x2802, 0x3011}, 0x11, 0, map[int]int{0x20: 0}},
+	{"BTFSC", []int{0x1003, 0x1803, 0x3011}, 0x00, 0, nil},
+	{"BTFSS", []int{0x1403, 0x1C03, 0x3011}, 0x00, 1 << C, nil},
+	{"CALL RETLW", []int{0x2003, 0x00A0, 0x2804, 0x3477}, 0x77, 0, map[int]int{0x20: 0x77}},
+	{"CALL RETURN", []int{0x2002, 0x2804, 0x3033, 0x0008}, 0x33, 0, nil},
+	{"computed jump", []int{0x3001, 0x0782, 0x2804, 0x3033}, 0x33, 0, nil},
+	{"indirect", []int{0x3025, 0x0084, 0x3099, 0x0080, 0x0825}, 0x99, 0, map[int]int{0x25: 0x99}},
+	{"bank 1", []int{0x1683, 0x3044, 0x00A0, 0x1283}, 0x44, 0, map[int]int{0xA0: 0x44, 0x20: 0}},
+	{"common register", []int{0x1683, 0x3055, 0x00F0, 0x1283, 0x0870}, 0x55, 0, map[int]int{0x70: 0x55}},
+}
+
+func TestInstructions(t *testing.T) {
+	for _, tt := range instrTests {
+		c := New(tt.code, 4, f688)
+		c.Run(1000)
+		if !c.Halted() {
+			t.Errorf("%s: did not halt", tt.name)
+			continue
+		}
+		if c.W != tt.w {
+			t.Errorf("%s: W = %#.2x, want %#.2x", tt.name, c.W, tt.w)
+		}
+		if s := c.Reg(STATUS) & flags; s != tt.status {
+			t.Errorf("%s: C, DC, Z = %03b, want %03b", tt.name, s, tt.status)
+		}
+		for a, v := range tt.regs {
+			if got := c.Reg(a); got != v {
+				t.Errorf("%s: register %#.3x = %#.2x, want %#.2x", tt.name, a, got, v)
+			}
+		}
+	}
+}
+
+func TestCycles(t *testing.T) {
+	// MOVLW 1, GOTO 2, BTFSS STATUS,C skipping, NOP, CALL 6, RETURN
+	c := New([]int{0x3001, 0x2802, 0x1C03, 0x0000, 0x2006, 0x2807, 0x0008}, 4, f688)
+	c.Run(1000)
+	if want := 1 + 2 + 2 + 2 + 2 + 2; c.Cycles != want {
+		t.Errorf("%d cycles, want %d", c.Cycles, want)
+	}
+}
+
+func TestSleep(t *testing.T) {
+	c := New([]int{0x0064, 0x0063, 0x3011}, 4, f688)
+	c.Run(1000)
+	if !c.Asleep || c.PC != 2 {
+		t.Fatalf("asleep %v at %#x, want asleep at 0x002", c.Asleep, c.PC)
+	}
+	if s := c.Reg(STATUS); s&(1<<TO|1<<PD) != 1<<TO {
+		t.Errorf("STATUS = %#.2x, want TO set and PD clear", s)
+	}
+}
+
+func TestInterrupt(t *testing.T) {
+	// 0: BSF INTCON,GIE; 1: GOTO 1; 4: INCF 0x20,F; RETFIE
+	code := []int{0x178B, 0x2801, 0x0000, 0x0000, 0x0AA0, 0x0009}
+	c := New(code, 4, f688)
+	if c.Interrupt() {
+		t.Fatal("interrupt taken with GIE clear")
+	}
+	c.Run(10)
+	if !c.Interrupt() {
+		t.Fatal("interrupt not taken with GIE set")
+	}
+	if c.PC != Vector || c.Reg(INTCON)&0x80 != 0 {
+		t.Fatalf("PC %#x INTCON %#.2x after interrupt", c.PC, c.Reg(INTCON))
+	}
+	c.Run(4)
+	if c.PC != 1 || c.Reg(INTCON)&0x80 == 0 || c.Reg(0x20) != 1 {
+		t.Errorf("PC %#x INTCON %#.2x count %d after RETFIE", c.PC, c.Reg(INTCON), c.Reg(0x20))
+	}
+}
+
+func TestEEPROM(t *testing.T) {
+	// EEDAT 0x1A, EEADR 0x1B, EECON1 0x1C: read byte 1, add one, write it
+	code := []int{0x3001, 0x009B, 0x141C, 0x081A, 0x3E01, 0x009A, 0x151C, 0x149C}
+	c := New(code, 4, f688)
+	c.EE = &EEPROM{Data: []int{0, 41, 0}, Dat: 0x1A, Adr: 0x1B, Con1: 0x1C}
+	c.Run(1000)
+	if c.EE.Data[1] != 42 {
+		t.Errorf("EEPROM byte 1 = %d, want 42", c.EE.Data[1])
+	}
+	if c.Reg(0x1C)&(1<<RD|1<<WR) != 0 {
+		t.Errorf("EECON1 = %#.2x, RD and WR should clear", c.Reg(0x1C))
+	}
+}
+
+func TestSharedRAM(t *testing.T) {
+	// BSF STATUS,RP0; MOVLW 5; MOVWF 0x0C; BSF STATUS,RP1; INCF 0x0D,F
+	code := []int{0x1683, 0x3005, 0x008C, 0x1703, 0x0A8D}
+	c := New(code, 2, f84)
+	c.Run(1000)
+	if c.Reg(0x0C) != 5 || c.Reg(0x8C) != 5 {
+		t.Errorf("16F84A: 0x0C = %d, 0x8C = %d, want 5 in both banks", c.Reg(0x0C), c.Reg(0x8C))
+	}
+	if c.Reg(0x0D) != 1 {
+		t.Errorf("16F84A: 0x0D = %d, want 1, RP1 is ignored", c.Reg(0x0D))
+	}
+
+	c = New(code, 4, f688)
+	c.Run(1000)
+	if c.Reg(0x0C) != 0 || c.Reg(0x8C) != 5 || c.Reg(0x18D) != 1 {
+		t.Errorf("16F688: 0x0C = %d, 0x8C = %d, 0x18D = %d, want 0, 5, 1", c.Reg(0x0C), c.Reg(0x8C), c.Reg(0x18D))
+	}
+}